@@ -0,0 +1,241 @@
+package wepi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat selects the line format written by the access logger.
+type AccessLogFormat int
+
+const (
+	// AccessLogCommon writes Apache Common Log Format lines.
+	AccessLogCommon AccessLogFormat = iota
+	// AccessLogCombined writes Apache Combined Log Format lines (Common plus referer and user agent).
+	AccessLogCombined
+	// AccessLogJSON writes one JSON object per line.
+	AccessLogJSON
+)
+
+// Field names accepted by AccessLogConfig.RedactFields.
+const (
+	AccessFieldRemoteAddr = "remote_addr"
+	AccessFieldUser       = "user"
+	AccessFieldURI        = "uri"
+	AccessFieldReferer    = "referer"
+	AccessFieldUserAgent  = "user_agent"
+)
+
+const redacted = "[REDACTED]"
+
+// AccessLogConfig configures the built-in access logger.
+type AccessLogConfig struct {
+	Output io.Writer
+	Format AccessLogFormat
+
+	// SampleRate is the fraction of requests logged, between 0 and 1.
+	// Zero logs every request. Server errors are always logged.
+	SampleRate float64
+
+	// Headers lists request headers included in JSON lines.
+	Headers []string
+	// RedactHeaders lists headers whose values are replaced in JSON lines.
+	RedactHeaders []string
+	// RedactFields lists fields (see the AccessField constants) that are blanked out.
+	RedactFields []string
+	// RedactQueryParams lists query parameters whose values are masked in the logged URI.
+	RedactQueryParams []string
+}
+
+// accessLogger writes access log lines; the mutex keeps lines from interleaving.
+type accessLogger struct {
+	config        AccessLogConfig
+	redactHeaders map[string]bool
+	redactFields  map[string]bool
+	redactQuery   map[string]bool
+	mu            sync.Mutex
+}
+
+// SetAccessLog enables the access logger. Routes can opt out with Route.SkipAccessLog.
+func (w *WepiController) SetAccessLog(config AccessLogConfig) {
+	if config.Output == nil {
+		w.update(func(s *settings) { s.accessLog = nil })
+		return
+	}
+
+	a := &accessLogger{
+		config:        config,
+		redactHeaders: make(map[string]bool),
+		redactFields:  make(map[string]bool),
+		redactQuery:   make(map[string]bool),
+	}
+	for _, h := range config.RedactHeaders {
+		a.redactHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+	for _, f := range config.RedactFields {
+		a.redactFields[f] = true
+	}
+	for _, q := range config.RedactQueryParams {
+		a.redactQuery[q] = true
+	}
+	w.update(func(s *settings) { s.accessLog = a })
+}
+
+// accessEntry holds the values of one access log line.
+type accessEntry struct {
+	Time       time.Time         `json:"time"`
+	RemoteAddr string            `json:"remote_addr"`
+	User       string            `json:"user"`
+	Method     string            `json:"method"`
+	URI        string            `json:"uri"`
+	Proto      string            `json:"proto"`
+	Route      string            `json:"route"`
+	RequestID  string            `json:"request_id,omitempty"`
+	Status     int               `json:"status"`
+	Bytes      int64             `json:"bytes"`
+	DurationMS float64           `json:"duration_ms"`
+	Referer    string            `json:"referer"`
+	UserAgent  string            `json:"user_agent"`
+	Headers    map[string]string `json:"headers,omitempty"`
+}
+
+// log writes the line for a handled request, honouring sampling and route opt-out.
+func (a *accessLogger) log(req *http.Request, info *requestInfo, wr *trackingWriter, start time.Time) {
+	if info.route != nil && info.route.skipAccessLog {
+		return
+	}
+	rate := a.config.SampleRate
+	if rate > 0 && rate < 1 && wr.status < http.StatusInternalServerError && rand.Float64() >= rate {
+		return
+	}
+
+	entry := a.entry(req, info, wr, start)
+
+	var line []byte
+	switch a.config.Format {
+	case AccessLogJSON:
+		line, _ = json.Marshal(entry)
+	case AccessLogCombined:
+		line = fmt.Appendf(nil, "%s %q %q", commonLine(entry), dashIfEmpty(entry.Referer), dashIfEmpty(entry.UserAgent))
+	default:
+		line = []byte(commonLine(entry))
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.config.Output.Write(line)
+}
+
+func (a *accessLogger) entry(req *http.Request, info *requestInfo, wr *trackingWriter, start time.Time) *accessEntry {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	user, _, _ := req.BasicAuth()
+	if user == "" && req.URL.User != nil {
+		user = req.URL.User.Username()
+	}
+
+	entry := &accessEntry{
+		Time:       start,
+		RemoteAddr: host,
+		User:       user,
+		Method:     info.method,
+		URI:        a.uri(req),
+		Proto:      req.Proto,
+		Route:      info.routeTemplate(),
+		RequestID:  info.requestID,
+		Status:     wr.status,
+		Bytes:      wr.bytes,
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+		Referer:    req.Referer(),
+		UserAgent:  req.UserAgent(),
+	}
+
+	if a.config.Format == AccessLogJSON && len(a.config.Headers) > 0 {
+		entry.Headers = make(map[string]string)
+		for _, h := range a.config.Headers {
+			key := http.CanonicalHeaderKey(h)
+			value := req.Header.Get(key)
+			if value != "" && a.redactHeaders[key] {
+				value = redacted
+			}
+			entry.Headers[key] = value
+		}
+	}
+
+	a.redact(entry)
+	return entry
+}
+
+// uri returns the request URI with redacted query parameter values masked.
+func (a *accessLogger) uri(req *http.Request) string {
+	uri := req.URL.RequestURI()
+	if len(a.redactQuery) == 0 || req.URL.RawQuery == "" {
+		return uri
+	}
+
+	query := req.URL.Query()
+	for key := range query {
+		if a.redactQuery[key] {
+			for i := range query[key] {
+				query[key][i] = redacted
+			}
+		}
+	}
+	u := url.URL{Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: query.Encode()}
+	return u.RequestURI()
+}
+
+func (a *accessLogger) redact(entry *accessEntry) {
+	fields := map[string]*string{
+		AccessFieldRemoteAddr: &entry.RemoteAddr,
+		AccessFieldUser:       &entry.User,
+		AccessFieldURI:        &entry.URI,
+		AccessFieldReferer:    &entry.Referer,
+		AccessFieldUserAgent:  &entry.UserAgent,
+	}
+	for name, field := range fields {
+		if a.redactFields[name] {
+			*field = redacted
+		}
+	}
+}
+
+// commonLine formats an entry in Common Log Format:
+// host ident authuser [date] "request" status bytes
+func commonLine(e *accessEntry) string {
+	size := "-"
+	if e.Bytes > 0 {
+		size = fmt.Sprint(e.Bytes)
+	}
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s`,
+		clfField(e.RemoteAddr),
+		clfField(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, clfField(e.URI), e.Proto,
+		e.Status,
+		size,
+	)
+}
+
+// clfField renders empty or redacted values as "-" so the line stays parseable.
+func clfField(s string) string {
+	return strings.ReplaceAll(dashIfEmpty(s), " ", "%20")
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" || s == redacted {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,132 @@
+package wepi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog_CommonFormat(t *testing.T) {
+	w := Get()
+	var buf bytes.Buffer
+	w.SetAccessLog(AccessLogConfig{Output: &buf, Format: AccessLogCommon})
+
+	AddGET[string](w, "/hello", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "hello", nil, nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/hello?x=1", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	req.SetBasicAuth("alice", "secret")
+	w.Run("", req, httptest.NewRecorder())
+
+	pattern := `^10\.0\.0\.1 - alice \[[^\]]+\] "GET /hello\?x=1 HTTP/1\.1" 200 5\n$`
+	if !regexp.MustCompile(pattern).MatchString(buf.String()) {
+		t.Errorf("line = %q, want match for %s", buf.String(), pattern)
+	}
+}
+
+func TestAccessLog_CombinedFormat_CustomResponse(t *testing.T) {
+	w := Get()
+	var buf bytes.Buffer
+	w.SetAccessLog(AccessLogConfig{Output: &buf, Format: AccessLogCombined})
+
+	AddGET[string](w, "/created", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "", Custom().SetStatus(http.StatusCreated).SetBodyString("done"), nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/created", nil)
+	req.Header.Set("Referer", "https://example.com/")
+	req.Header.Set("User-Agent", "test-agent")
+	w.Run("", req, httptest.NewRecorder())
+
+	line := buf.String()
+	if !strings.Contains(line, `" 201 4 "https://example.com/" "test-agent"`) {
+		t.Errorf("line = %q, want status, bytes, referer and user agent", line)
+	}
+}
+
+func TestAccessLog_JSONWithRedaction(t *testing.T) {
+	w := Get()
+	var buf bytes.Buffer
+	w.SetAccessLog(AccessLogConfig{
+		Output:            &buf,
+		Format:            AccessLogJSON,
+		Headers:           []string{"Authorization", "X-Tenant"},
+		RedactHeaders:     []string{"authorization"},
+		RedactFields:      []string{AccessFieldRemoteAddr},
+		RedactQueryParams: []string{"token"},
+	})
+
+	AddGET[string](w, "/items/{id}", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/items/5?token=abc&page=2", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	req.Header.Set("X-Tenant", "acme")
+	w.Run("", req, httptest.NewRecorder())
+
+	var entry accessEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to unmarshal line %q: %v", buf.String(), err)
+	}
+	if entry.Route != "/items/{id}" {
+		t.Errorf("route = %q, want /items/{id}", entry.Route)
+	}
+	if entry.Headers["Authorization"] != redacted {
+		t.Errorf("Authorization = %q, want redacted", entry.Headers["Authorization"])
+	}
+	if entry.Headers["X-Tenant"] != "acme" {
+		t.Errorf("X-Tenant = %q, want acme", entry.Headers["X-Tenant"])
+	}
+	if entry.RemoteAddr != redacted {
+		t.Errorf("remote_addr = %q, want redacted", entry.RemoteAddr)
+	}
+	if strings.Contains(entry.URI, "abc") || !strings.Contains(entry.URI, "page=2") {
+		t.Errorf("uri = %q, want token masked and page kept", entry.URI)
+	}
+}
+
+func TestAccessLog_RouteOptOut(t *testing.T) {
+	w := Get()
+	var buf bytes.Buffer
+	w.SetAccessLog(AccessLogConfig{Output: &buf})
+
+	AddGET[string](w, "/health", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	}).SkipAccessLog()
+
+	w.Run("", httptest.NewRequest(http.MethodGet, "/health", nil), httptest.NewRecorder())
+
+	if buf.Len() != 0 {
+		t.Errorf("expected no access log line, got %q", buf.String())
+	}
+}
+
+func TestAccessLog_SamplingKeepsServerErrors(t *testing.T) {
+	w := Get()
+	var buf bytes.Buffer
+	w.SetAccessLog(AccessLogConfig{Output: &buf, SampleRate: 0.0000001})
+
+	AddGET[string](w, "/ok", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	})
+	AddGET[string](w, "/broken", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "", Custom().SetStatus(http.StatusBadGateway), nil
+	})
+
+	for range 10 {
+		w.Run("", httptest.NewRequest(http.MethodGet, "/ok", nil), httptest.NewRecorder())
+	}
+	w.Run("", httptest.NewRequest(http.MethodGet, "/broken", nil), httptest.NewRecorder())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], " 502 ") {
+		t.Errorf("lines = %q, want only the 502", lines)
+	}
+}
@@ -1,6 +1,10 @@
 package wepi
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+	"slices"
+)
 
 const (
 	POST  = "POST"
@@ -9,11 +13,95 @@ const (
 )
 
 // Route represents a registered route with its handler and middleware chain.
+// Composers return the registered route so per-route options can be chained onto it.
 type Route struct {
 	route        string
 	method       string
 	RouteHandler any
 	Middlewares  []func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error)
+
+	ctxMiddlewares  []ContextMiddleware
+	provides        []AnyKey
+	consumes        []AnyKey
+	interceptors    []Interceptor
+	httpMiddlewares []func(http.Handler) http.Handler
+	skipAccessLog   bool
+	skipCompression bool
+	public          bool
+	cors            *corsPolicy
+	maxBodyBytes    *int64
+	jsonLimits      *JSONLimits
+	version         func(params ParamsManager, req *http.Request) (ResourceVersion, error)
+
+	controller *WepiController
+	pattern    *PathReader // nil for templates without parameters
+	origin     *Route      // on published copies, the route they were copied from
+}
+
+// SkipAccessLog excludes this route from the access log (e.g. health checks).
+func (r *Route) SkipAccessLog() *Route {
+	return r.update(func(r *Route) { r.skipAccessLog = true })
+}
+
+// update applies fn to the route and republishes it, so requests being served
+// never see a route that is being changed.
+func (r *Route) update(fn func(r *Route)) *Route {
+	w := r.controller
+	if w == nil {
+		fn(r)
+		return r
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fn(r)
+	key := r.route + r.method
+	if published, ok := w.table.Load().routes[key]; ok && published.origin == r {
+		w.updateTable(func(t *routeTable) { t.routes[key] = r.snapshot() })
+	}
+	return r
+}
+
+// snapshot returns a copy of the route for the route table.
+func (r *Route) snapshot() *Route {
+	c := *r
+	c.Middlewares = slices.Clip(c.Middlewares)
+	c.ctxMiddlewares = slices.Clip(c.ctxMiddlewares)
+	c.provides = slices.Clip(c.provides)
+	c.consumes = slices.Clip(c.consumes)
+	c.interceptors = slices.Clip(c.interceptors)
+	c.httpMiddlewares = slices.Clip(c.httpMiddlewares)
+	c.origin = r
+	return &c
+}
+
+// published returns the copy of the route requests currently see. Routes that
+// are no longer in the route table are served from a fresh copy.
+func (r *Route) published() *Route {
+	w := r.controller
+	if published, ok := w.table.Load().routes[r.route+r.method]; ok && published.origin == r {
+		return published
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return r.snapshot()
+}
+
+// middlewareChain returns the route's middlewares in run order, with plain
+// middlewares lifted to ContextMiddleware. Nil entries are skipped.
+func (r *Route) middlewareChain() []ContextMiddleware {
+	chain := make([]ContextMiddleware, 0, len(r.Middlewares)+len(r.ctxMiddlewares))
+	for _, m := range r.Middlewares {
+		if m != nil {
+			chain = append(chain, FromMiddleware(m))
+		}
+	}
+	for _, m := range r.ctxMiddlewares {
+		if m != nil {
+			chain = append(chain, m)
+		}
+	}
+	return chain
 }
 
 // RouteHandlerWithStruct handles routes that expect a typed request body.
@@ -26,8 +114,18 @@ type RouteHandlerSimple[R any] struct {
 	Handler func(params ParamsManager, req *http.Request) (R, *CustomResponse, error)
 }
 
+// RouteHandlerWithStructCtx handles routes that expect a typed request body and take the request context.
+type RouteHandlerWithStructCtx[ST any, R any] struct {
+	Handler func(ctx context.Context, st ST, params ParamsManager, req *http.Request) (R, *CustomResponse, error)
+}
+
+// RouteHandlerSimpleCtx handles routes that use only query/form params and take the request context.
+type RouteHandlerSimpleCtx[R any] struct {
+	Handler func(ctx context.Context, params ParamsManager, req *http.Request) (R, *CustomResponse, error)
+}
+
 // AddJsonPOST registers a POST route that expects a JSON request body deserialized into type T.
-func AddJsonPOST[T any, R any](wepiController *WepiController, path string, function func(st T, params ParamsManager, req *http.Request) (R, *CustomResponse, error), middlewares ...func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error)) {
+func AddJsonPOST[T any, R any](wepiController Registrar, path string, function func(st T, params ParamsManager, req *http.Request) (R, *CustomResponse, error), middlewares ...func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error)) *Route {
 	r := &RouteHandlerWithStruct[T, R]{
 		Handler: function,
 	}
@@ -43,10 +141,11 @@ func AddJsonPOST[T any, R any](wepiController *WepiController, path string, func
 		route:  ro,
 		method: method,
 	})
+	return ro
 }
 
 // AddFormPost registers a POST route that reads form-encoded data via ParamsManager.
-func AddFormPost[R any](wepiController *WepiController, path string, function func(params ParamsManager, req *http.Request) (R, *CustomResponse, error), middlewares ...func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error)) {
+func AddFormPost[R any](wepiController Registrar, path string, function func(params ParamsManager, req *http.Request) (R, *CustomResponse, error), middlewares ...func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error)) *Route {
 	r := &RouteHandlerSimple[R]{
 		Handler: function,
 	}
@@ -62,10 +161,11 @@ func AddFormPost[R any](wepiController *WepiController, path string, function fu
 		route:  ro,
 		method: method,
 	})
+	return ro
 }
 
 // AddGetWithStruct registers a GET route that deserializes query parameters into type T.
-func AddGetWithStruct[T any, R any](wepiController *WepiController, path string, function func(st T, params ParamsManager, req *http.Request) (R, *CustomResponse, error), middlewares ...func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error)) {
+func AddGetWithStruct[T any, R any](wepiController Registrar, path string, function func(st T, params ParamsManager, req *http.Request) (R, *CustomResponse, error), middlewares ...func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error)) *Route {
 	r := &RouteHandlerWithStruct[T, R]{
 		Handler: function,
 	}
@@ -81,10 +181,11 @@ func AddGetWithStruct[T any, R any](wepiController *WepiController, path string,
 		route:  ro,
 		method: method,
 	})
+	return ro
 }
 
 // AddGET registers a GET route that reads query parameters via ParamsManager.
-func AddGET[R any](wepiController *WepiController, path string, function func(params ParamsManager, req *http.Request) (R, *CustomResponse, error), middlewares ...func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error)) {
+func AddGET[R any](wepiController Registrar, path string, function func(params ParamsManager, req *http.Request) (R, *CustomResponse, error), middlewares ...func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error)) *Route {
 	r := &RouteHandlerSimple[R]{
 		Handler: function,
 	}
@@ -100,4 +201,85 @@ func AddGET[R any](wepiController *WepiController, path string, function func(pa
 		route:  ro,
 		method: method,
 	})
+	return ro
+}
+
+// AddJsonPOSTCtx is AddJsonPOST for handlers that take the request context first.
+func AddJsonPOSTCtx[T any, R any](wepiController Registrar, path string, function func(ctx context.Context, st T, params ParamsManager, req *http.Request) (R, *CustomResponse, error), middlewares ...ContextMiddleware) *Route {
+	r := &RouteHandlerWithStructCtx[T, R]{
+		Handler: function,
+	}
+	method := POST
+	ro := &Route{
+		route:          path,
+		method:         method,
+		RouteHandler:   r,
+		ctxMiddlewares: middlewares,
+	}
+	wepiController.addRoute(&WepiComposedRoute{
+		path:   path,
+		route:  ro,
+		method: method,
+	})
+	return ro
+}
+
+// AddFormPostCtx is AddFormPost for handlers that take the request context first.
+func AddFormPostCtx[R any](wepiController Registrar, path string, function func(ctx context.Context, params ParamsManager, req *http.Request) (R, *CustomResponse, error), middlewares ...ContextMiddleware) *Route {
+	r := &RouteHandlerSimpleCtx[R]{
+		Handler: function,
+	}
+	method := POST
+	ro := &Route{
+		route:          path,
+		method:         method,
+		RouteHandler:   r,
+		ctxMiddlewares: middlewares,
+	}
+	wepiController.addRoute(&WepiComposedRoute{
+		path:   path,
+		route:  ro,
+		method: method,
+	})
+	return ro
+}
+
+// AddGetWithStructCtx is AddGetWithStruct for handlers that take the request context first.
+func AddGetWithStructCtx[T any, R any](wepiController Registrar, path string, function func(ctx context.Context, st T, params ParamsManager, req *http.Request) (R, *CustomResponse, error), middlewares ...ContextMiddleware) *Route {
+	r := &RouteHandlerWithStructCtx[T, R]{
+		Handler: function,
+	}
+	method := GET
+	ro := &Route{
+		route:          path,
+		method:         method,
+		RouteHandler:   r,
+		ctxMiddlewares: middlewares,
+	}
+	wepiController.addRoute(&WepiComposedRoute{
+		path:   path,
+		route:  ro,
+		method: method,
+	})
+	return ro
+}
+
+// AddGETCtx is AddGET for handlers that take the request context first.
+func AddGETCtx[R any](wepiController Registrar, path string, function func(ctx context.Context, params ParamsManager, req *http.Request) (R, *CustomResponse, error), middlewares ...ContextMiddleware) *Route {
+	r := &RouteHandlerSimpleCtx[R]{
+		Handler: function,
+	}
+	method := GET
+	ro := &Route{
+		route:          path,
+		method:         method,
+		RouteHandler:   r,
+		ctxMiddlewares: middlewares,
+	}
+	wepiController.addRoute(&WepiComposedRoute{
+		path:   path,
+		route:  ro,
+		method: method,
+	})
+	return ro
 }
@@ -1,7 +1,9 @@
 package wepi
 
 import (
+	"context"
 	"net/http"
+	"reflect"
 	"testing"
 )
 
@@ -16,11 +18,10 @@ func TestAddJsonPOST(t *testing.T) {
 		return "ok", nil, nil
 	})
 
-	r, ok := w.routes.Load("/post" + POST)
+	route, ok := w.lookupRoute("/post" + POST)
 	if !ok {
 		t.Fatal("expected route to be registered")
 	}
-	route := r.(*Route)
 	if route.method != POST {
 		t.Errorf("method = %q, want %q", route.method, POST)
 	}
@@ -37,11 +38,10 @@ func TestAddGetWithStruct(t *testing.T) {
 		return "ok", nil, nil
 	})
 
-	r, ok := w.routes.Load("/search" + GET)
+	route, ok := w.lookupRoute("/search" + GET)
 	if !ok {
 		t.Fatal("expected route to be registered")
 	}
-	route := r.(*Route)
 	if route.method != GET {
 		t.Errorf("method = %q, want %q", route.method, GET)
 	}
@@ -54,12 +54,92 @@ func TestAddGET(t *testing.T) {
 		return "ok", nil, nil
 	})
 
-	r, ok := w.routes.Load("/get" + GET)
+	route, ok := w.lookupRoute("/get" + GET)
 	if !ok {
 		t.Fatal("expected route to be registered")
 	}
-	route := r.(*Route)
 	if route.method != GET {
 		t.Errorf("method = %q, want %q", route.method, GET)
 	}
 }
+
+func TestAddGETCtx(t *testing.T) {
+	w := Get()
+
+	mw := func(ctx context.Context, value any, params ParamsManager, req *http.Request) (context.Context, *CustomResponse, error) {
+		return nil, nil, nil
+	}
+	AddGETCtx[string](w, "/ctx", func(ctx context.Context, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	}, mw)
+
+	route, ok := w.lookupRoute("/ctx" + GET)
+	if !ok {
+		t.Fatal("expected route to be registered")
+	}
+	if len(route.ctxMiddlewares) != 1 {
+		t.Errorf("ctxMiddlewares = %d, want 1", len(route.ctxMiddlewares))
+	}
+
+	_, stType, err := validateAndExtractRouteFunc(route)
+	if err != nil {
+		t.Fatalf("validateAndExtractRouteFunc: %v", err)
+	}
+	if stType != reflect.TypeOf(ParamsManager{}) {
+		t.Errorf("structType = %v, want ParamsManager", stType)
+	}
+}
+
+func TestAddJsonPOSTCtx(t *testing.T) {
+	w := Get()
+
+	type Input struct {
+		Name string `json:"name"`
+	}
+
+	AddJsonPOSTCtx[Input, string](w, "/ctx-post", func(ctx context.Context, st Input, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	})
+
+	route, ok := w.lookupRoute("/ctx-post" + POST)
+	if !ok {
+		t.Fatal("expected route to be registered")
+	}
+	_, stType, err := validateAndExtractRouteFunc(route)
+	if err != nil {
+		t.Fatalf("validateAndExtractRouteFunc: %v", err)
+	}
+	if stType != reflect.TypeOf(Input{}) {
+		t.Errorf("structType = %v, want Input", stType)
+	}
+}
+
+func TestMiddlewareChain_SkipsNilAndOrders(t *testing.T) {
+	var order []string
+	route := &Route{
+		Middlewares: []func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error){
+			nil,
+			func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+				order = append(order, "plain")
+				return nil, nil
+			},
+		},
+		ctxMiddlewares: []ContextMiddleware{
+			func(ctx context.Context, value any, params ParamsManager, req *http.Request) (context.Context, *CustomResponse, error) {
+				order = append(order, "ctx")
+				return ctx, nil, nil
+			},
+		},
+	}
+
+	chain := route.middlewareChain()
+	if len(chain) != 2 {
+		t.Fatalf("chain length = %d, want 2", len(chain))
+	}
+	for _, m := range chain {
+		m(context.Background(), nil, ParamsManager{}, nil)
+	}
+	if len(order) != 2 || order[0] != "plain" || order[1] != "ctx" {
+		t.Errorf("order = %v, want [plain ctx]", order)
+	}
+}
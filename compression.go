@@ -0,0 +1,272 @@
+package wepi
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultCompressibleTypes are the content types compressed when CompressionConfig.ContentTypes is nil.
+var DefaultCompressibleTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/x-ndjson",
+	"application/javascript",
+	"application/xml",
+	"application/*+xml",
+	"image/svg+xml",
+}
+
+// CompressionConfig configures response compression.
+type CompressionConfig struct {
+	MinSize      int      // smaller bodies are sent as is; 1024 if 0
+	ContentTypes []string // exact types or "*" wildcards like "text/*"; DefaultCompressibleTypes if nil
+	Level        int      // gzip/flate level from flate.HuffmanOnly to flate.BestCompression; flate.DefaultCompression if 0
+}
+
+type compression struct {
+	minSize int
+	types   []string
+	gzip    sync.Pool
+	flate   sync.Pool
+}
+
+// EnableCompression compresses responses with gzip or deflate when the client
+// accepts it, the content type is allowed and the body reaches MinSize.
+// Responses that already have a Content-Encoding are left alone. An out of range
+// Level is logged as a warning and replaced by flate.DefaultCompression.
+func (w *WepiController) EnableCompression(config CompressionConfig) {
+	if config.MinSize == 0 {
+		config.MinSize = 1024
+	}
+	if config.ContentTypes == nil {
+		config.ContentTypes = DefaultCompressibleTypes
+	}
+	level := config.Level
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		w.cfg().logger.Warn("invalid compression level, using the default", "level", level)
+		level = 0
+	}
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	c := &compression{minSize: config.MinSize, types: config.ContentTypes}
+	c.gzip.New = func() any {
+		gz, _ := gzip.NewWriterLevel(io.Discard, level)
+		return gz
+	}
+	c.flate.New = func() any {
+		fl, _ := flate.NewWriter(io.Discard, level)
+		return fl
+	}
+	w.update(func(s *settings) { s.compression = c })
+}
+
+// SkipCompression sends the route's responses uncompressed.
+func (r *Route) SkipCompression() *Route {
+	return r.update(func(r *Route) { r.skipCompression = true })
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header, or "".
+func negotiateEncoding(accept string) string {
+	best, bestQ := "", 0.0
+	wildcard := -1.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		switch name {
+		case "gzip", "deflate":
+			if q > bestQ || (q > 0 && q == bestQ && name == "gzip") {
+				best, bestQ = name, q
+			}
+		case "*":
+			wildcard = q
+		}
+	}
+	if best == "" && wildcard > 0 {
+		return "gzip"
+	}
+	return best
+}
+
+// compressible reports whether responses of contentType may be compressed.
+func (c *compression) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.types {
+		prefix, suffix, wildcard := strings.Cut(t, "*")
+		if t == mediaType || (wildcard && len(mediaType) >= len(prefix)+len(suffix) && strings.HasPrefix(mediaType, prefix) && strings.HasSuffix(mediaType, suffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter buffers the start of a response until it knows whether to
+// compress it: once MinSize bytes are written, on Flush, or on close.
+type compressWriter struct {
+	http.ResponseWriter
+	c        *compression
+	encoding string
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     interface {
+		io.Writer
+		Flush() error
+		Close() error
+		Reset(w io.Writer)
+	}
+}
+
+// compressResponse returns a writer compressing the response of req if compression
+// is enabled for route and the client accepts it. Call close when the handler is done,
+// with aborted set if it panicked.
+func (w *WepiController) compressResponse(route *Route, wr http.ResponseWriter, req *http.Request) (http.ResponseWriter, func(aborted bool)) {
+	c := w.cfg().compression
+	if c == nil || route.skipCompression || req.Method == http.MethodHead || req.Header.Get("Upgrade") != "" {
+		return wr, func(bool) {}
+	}
+	wr.Header().Add("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return wr, func(bool) {}
+	}
+	cw := &compressWriter{ResponseWriter: wr, c: c, encoding: encoding}
+	return cw, cw.close
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(status) // informational, the response isn't committed
+		return
+	}
+	if cw.decided || cw.status != 0 {
+		return // like net/http, only the first status counts
+	}
+	cw.status = status
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.c.minSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// decide commits the headers, starting compression if large is set and the
+// response qualifies, then writes the buffered bytes.
+func (cw *compressWriter) decide(large bool) error {
+	cw.decided = true
+	h := cw.Header()
+	status := cw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	if large && cw.qualifies(status) {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges") // ranges would refer to the uncompressed bytes
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag) // the compressed bytes are a different representation
+		}
+		if cw.encoding == "gzip" {
+			cw.enc = cw.c.gzip.Get().(*gzip.Writer)
+		} else {
+			cw.enc = cw.c.flate.Get().(*flate.Writer)
+		}
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if cw.enc != nil {
+		_, err := cw.enc.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+func (cw *compressWriter) qualifies(status int) bool {
+	h := cw.Header()
+	return status != http.StatusNoContent && status != http.StatusNotModified && status != http.StatusPartialContent &&
+		h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		cw.c.compressible(h.Get("Content-Type"))
+}
+
+// Flush sends what was written so far, compressed if the response qualifies.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close finishes the response: small bodies go out as is, compressed ones get
+// their trailer and the encoder goes back to the pool. When the handler aborted,
+// nothing more is written, so a started body stays truncated rather than looking
+// complete, but the encoder still goes back to the pool.
+func (cw *compressWriter) close(aborted bool) {
+	if aborted {
+		cw.buf = nil
+	} else if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			return // nothing was written; leave the response to the caller
+		}
+		cw.decide(false)
+	}
+	if cw.enc == nil {
+		return
+	}
+	if !aborted {
+		cw.enc.Close()
+	}
+	cw.enc.Reset(io.Discard)
+	if gz, ok := cw.enc.(*gzip.Writer); ok {
+		cw.c.gzip.Put(gz)
+	} else {
+		cw.c.flate.Put(cw.enc)
+	}
+	cw.enc = nil
+}
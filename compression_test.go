@@ -0,0 +1,269 @@
+package wepi
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type listItem struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func bigList() []listItem {
+	list := make([]listItem, 200)
+	for i := range list {
+		list[i] = listItem{ID: i, Name: "item name that repeats"}
+	}
+	return list
+}
+
+func getEncoded(w *WepiController, path, acceptEncoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+	return rr
+}
+
+func gunzip(t *testing.T, b []byte) string {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("reading gzip body: %v", err)
+	}
+	return string(out)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct{ accept, want string }{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;q=0", ""},
+		{"br, *", "gzip"},
+		{"identity", ""},
+		{"*;q=0", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.accept); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestCompression_LargeJSON(t *testing.T) {
+	w := Get()
+	w.EnableCompression(CompressionConfig{})
+	AddGET(w, "/list", func(params ParamsManager, req *http.Request) ([]listItem, *CustomResponse, error) {
+		return bigList(), nil, nil
+	})
+
+	plain := getEncoded(w, "/list", "")
+	rr := getEncoded(w, "/list", "gzip, deflate")
+
+	if got := rr.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := rr.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding", got)
+	}
+	if rr.Header().Get("Content-Length") != "" {
+		t.Error("Content-Length kept on compressed response")
+	}
+	if got := gunzip(t, rr.Body.Bytes()); got != plain.Body.String() {
+		t.Error("decompressed body differs from the uncompressed one")
+	}
+	if rr.Body.Len() >= plain.Body.Len() {
+		t.Errorf("compressed %d bytes, plain %d", rr.Body.Len(), plain.Body.Len())
+	}
+	if got := plain.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Errorf("uncompressed Vary = %q, want Accept-Encoding", got)
+	}
+}
+
+func TestCompression_Deflate(t *testing.T) {
+	w := Get()
+	w.EnableCompression(CompressionConfig{MinSize: 10})
+	AddGET(w, "/text", textHandler(strings.Repeat("hello ", 100)))
+
+	rr := getEncoded(w, "/text", "deflate")
+	if got := rr.Header().Get("Content-Encoding"); got != "deflate" {
+		t.Fatalf("Content-Encoding = %q, want deflate", got)
+	}
+	out, err := io.ReadAll(flate.NewReader(rr.Body))
+	if err != nil || string(out) != strings.Repeat("hello ", 100) {
+		t.Errorf("inflate: %q, %v", out, err)
+	}
+}
+
+func TestCompression_BelowMinSize(t *testing.T) {
+	w := Get()
+	w.EnableCompression(CompressionConfig{})
+	AddGET(w, "/small", textHandler("tiny"))
+
+	rr := getEncoded(w, "/small", "gzip")
+	if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != "tiny" {
+		t.Errorf("small body: encoding %q, body %q", rr.Header().Get("Content-Encoding"), rr.Body.String())
+	}
+}
+
+func TestCompression_ContentTypeAllowlist(t *testing.T) {
+	w := Get()
+	w.EnableCompression(CompressionConfig{MinSize: 10})
+	AddGET(w, "/png", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return strings.Repeat("x", 100), Custom().SetHeader("Content-Type", "image/png"), nil
+	})
+
+	rr := getEncoded(w, "/png", "gzip")
+	if rr.Header().Get("Content-Encoding") != "" {
+		t.Error("image/png was compressed")
+	}
+}
+
+func TestCompression_AlreadyEncodedLeftAlone(t *testing.T) {
+	w := Get()
+	w.EnableCompression(CompressionConfig{MinSize: 10})
+	var pre bytes.Buffer
+	zw := gzip.NewWriter(&pre)
+	zw.Write([]byte(strings.Repeat("a", 100)))
+	zw.Close()
+
+	AddGET(w, "/pre", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "", Custom().SetHeader("Content-Encoding", "gzip").SetHeader("Content-Type", "text/plain").SetBody(pre.Bytes()), nil
+	})
+
+	rr := getEncoded(w, "/pre", "gzip")
+	if got := gunzip(t, rr.Body.Bytes()); got != strings.Repeat("a", 100) {
+		t.Errorf("body compressed twice or altered: %q", got)
+	}
+}
+
+func TestCompression_StreamsReader(t *testing.T) {
+	w := Get()
+	w.EnableCompression(CompressionConfig{MinSize: 10})
+	body := strings.Repeat("line of text\n", 1000)
+	AddGET(w, "/file", func(params ParamsManager, req *http.Request) (io.Reader, *CustomResponse, error) {
+		return strings.NewReader(body), Custom().SetHeader("Content-Type", "text/plain"), nil
+	})
+
+	rr := getEncoded(w, "/file", "gzip")
+	if rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("reader result not compressed")
+	}
+	if rr.Header().Get("Accept-Ranges") != "" || rr.Header().Get("Content-Length") != "" {
+		t.Errorf("compressed reader kept Accept-Ranges %q, Content-Length %q", rr.Header().Get("Accept-Ranges"), rr.Header().Get("Content-Length"))
+	}
+	if got := gunzip(t, rr.Body.Bytes()); got != body {
+		t.Error("decompressed reader body differs")
+	}
+}
+
+func TestCompression_SkipAndStrongETag(t *testing.T) {
+	w := Get()
+	w.EnableCompression(CompressionConfig{MinSize: 10})
+	AddGET(w, "/skip", textHandler(strings.Repeat("s", 100))).SkipCompression()
+	AddGET(w, "/etag", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return strings.Repeat("e", 100), Custom().SetHeader("ETag", `"v1"`), nil
+	})
+
+	if rr := getEncoded(w, "/skip", "gzip"); rr.Header().Get("Content-Encoding") != "" {
+		t.Error("route with SkipCompression was compressed")
+	}
+	if rr := getEncoded(w, "/etag", "gzip"); rr.Header().Get("ETag") != `W/"v1"` {
+		t.Errorf("ETag = %q, want weak", rr.Header().Get("ETag"))
+	}
+}
+
+func TestCompression_PoolReuse(t *testing.T) {
+	w := Get()
+	w.EnableCompression(CompressionConfig{MinSize: 10})
+	AddGET(w, "/text", textHandler(strings.Repeat("pool ", 100)))
+
+	for i := 0; i < 5; i++ {
+		rr := getEncoded(w, "/text", "gzip")
+		if got := gunzip(t, rr.Body.Bytes()); got != strings.Repeat("pool ", 100) {
+			t.Fatalf("request %d: body differs", i)
+		}
+	}
+}
+
+func TestCompression_PanicAfterWrite(t *testing.T) {
+	w := Get()
+	w.EnableCompression(CompressionConfig{MinSize: 10})
+	var report PanicReport
+	w.SetPanicReporter(func(r PanicReport) { report = r })
+	panicAfter := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(wr, req)
+			panic("after the handler")
+		})
+	}
+	AddGET(w, "/big", textHandler(strings.Repeat("partial ", 100))).WrapHTTP(panicAfter)
+	AddGET(w, "/small", textHandler("tiny")).WrapHTTP(panicAfter)
+
+	req := httptest.NewRequest(http.MethodGet, "/big", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	if !runAborting(w, req, rr) {
+		t.Error("expected the committed response to be aborted")
+	}
+	if rr.Header().Get("Content-Encoding") != "gzip" || !report.HeadersWritten {
+		t.Fatalf("Content-Encoding = %q, HeadersWritten = %v", rr.Header().Get("Content-Encoding"), report.HeadersWritten)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(rr.Body.Bytes()))
+	if err == nil {
+		_, err = io.ReadAll(zr)
+	}
+	if err == nil {
+		t.Error("the body of a panicking handler was finished as a complete gzip stream")
+	}
+	if !strings.Contains(string(report.Stack), "TestCompression_PanicAfterWrite") {
+		t.Errorf("stack doesn't show where the panic happened:\n%s", report.Stack)
+	}
+
+	// A body still buffered when the panic happens is dropped for the 500
+	rr = getEncoded(w, "/small", "gzip")
+	if rr.Code != http.StatusInternalServerError || strings.Contains(rr.Body.String(), "tiny") || rr.Header().Get("Content-Encoding") != "" {
+		t.Errorf("got %d %q with Content-Encoding %q, want a plain 500", rr.Code, rr.Body.String(), rr.Header().Get("Content-Encoding"))
+	}
+
+	// The encoder went back to the pool in a usable state
+	AddGET(w, "/ok", textHandler(strings.Repeat("fine ", 100)))
+	if got := gunzip(t, getEncoded(w, "/ok", "gzip").Body.Bytes()); got != strings.Repeat("fine ", 100) {
+		t.Error("body differs after a panicking request")
+	}
+}
+
+func TestCompression_InvalidLevel(t *testing.T) {
+	var buf bytes.Buffer
+	w := Get()
+	w.SetLogger(newBufferLogger(&buf))
+	w.EnableCompression(CompressionConfig{MinSize: 10, Level: 12})
+	AddGET(w, "/text", textHandler(strings.Repeat("level ", 100)))
+
+	if !strings.Contains(buf.String(), "invalid compression level") {
+		t.Errorf("no warning logged: %s", buf.String())
+	}
+	rr := getEncoded(w, "/text", "gzip")
+	if rr.Code != http.StatusOK || gunzip(t, rr.Body.Bytes()) != strings.Repeat("level ", 100) {
+		t.Errorf("status = %d, want the body compressed at the default level", rr.Code)
+	}
+	if rr := getEncoded(w, "/text", "deflate"); rr.Code != http.StatusOK || rr.Header().Get("Content-Encoding") != "deflate" {
+		t.Errorf("deflate: status = %d, Content-Encoding = %q", rr.Code, rr.Header().Get("Content-Encoding"))
+	}
+}
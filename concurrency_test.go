@@ -0,0 +1,112 @@
+package wepi
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// These tests are meant to run with -race.
+
+func TestConcurrentRegistrationAndServing(t *testing.T) {
+	w := Get()
+	AddGET(w, "/stable/{id}", okHandler)
+
+	const plugins = 20
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Serve traffic against the stable route, newly registered routes and preflights
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rr := httptest.NewRecorder()
+				w.Run("", httptest.NewRequest(http.MethodGet, fmt.Sprintf("/stable/%d", n), nil), rr)
+				if rr.Code != http.StatusOK {
+					t.Errorf("stable route: status = %d", rr.Code)
+					return
+				}
+				w.Run("", httptest.NewRequest(http.MethodGet, fmt.Sprintf("/plugin%d/items/1", n%plugins), nil), httptest.NewRecorder())
+
+				pre := httptest.NewRequest(http.MethodOptions, "/stable/1", nil)
+				pre.Header.Set("Origin", "https://app.example")
+				pre.Header.Set("Access-Control-Request-Method", "GET")
+				w.Run("", pre, httptest.NewRecorder())
+			}
+		}()
+	}
+
+	// Plugins register routes and change settings meanwhile
+	var reg sync.WaitGroup
+	for i := 0; i < plugins; i++ {
+		reg.Add(1)
+		go func() {
+			defer reg.Done()
+			prefix := fmt.Sprintf("/plugin%d", i)
+			AddGET(w, prefix+"/items/{id}", okHandler).
+				SkipAccessLog().
+				Around(func(params ParamsManager, req *http.Request, next func(req *http.Request) *Outcome) *Outcome {
+					return next(req)
+				}).
+				WrapHTTP(func(next http.Handler) http.Handler { return next })
+			w.Group(prefix).WrapHTTP(func(next http.Handler) http.Handler { return next })
+			w.AddAllowedCORS(fmt.Sprintf("https://plugin%d.example", i))
+			w.Use(func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) { return nil, nil })
+			w.SetShowErrors()
+			w.SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+			w.EnableRequestID(RequestIDConfig{})
+		}()
+	}
+	reg.Wait()
+	close(stop)
+	wg.Wait()
+
+	for i := 0; i < plugins; i++ {
+		rr := httptest.NewRecorder()
+		w.Run("", httptest.NewRequest(http.MethodGet, fmt.Sprintf("/plugin%d/items/7", i), nil), rr)
+		if rr.Code != http.StatusOK {
+			t.Errorf("plugin%d route: status = %d, want 200", i, rr.Code)
+		}
+	}
+	if err := w.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConcurrentRouteOptionsWhileServing(t *testing.T) {
+	w := Get()
+	route := AddGET(w, "/x", okHandler)
+	mux := http.NewServeMux()
+	mux.Handle("/direct", route)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			w.Run("", httptest.NewRequest(http.MethodGet, "/x", nil), httptest.NewRecorder())
+			mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/direct", nil))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			route.Around(func(params ParamsManager, req *http.Request, next func(req *http.Request) *Outcome) *Outcome {
+				return next(req)
+			})
+			route.CORS(CORSConfig{AllowedOrigins: []string{"https://a.example"}})
+		}
+	}()
+	wg.Wait()
+}
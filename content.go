@@ -0,0 +1,94 @@
+package wepi
+
+import (
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Attachment makes clients save the response as filename.
+func (c *CustomResponse) Attachment(filename string) *CustomResponse {
+	return c.SetHeader("Content-Disposition", contentDisposition("attachment", filename))
+}
+
+// Inline makes clients display the response, suggesting filename if they save it.
+func (c *CustomResponse) Inline(filename string) *CustomResponse {
+	return c.SetHeader("Content-Disposition", contentDisposition("inline", filename))
+}
+
+// contentDisposition formats a disposition, using filename* for non-ASCII names.
+func contentDisposition(disposition, filename string) string {
+	if filename == "" {
+		return disposition
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+}
+
+// writeReader streams an io.Reader result. Readers that can seek, or read at an
+// offset with a known size, are served with http.ServeContent on GET and HEAD,
+// which answers Range, If-Range and the other conditional headers.
+func writeReader(wr http.ResponseWriter, req *http.Request, r io.Reader, status int) {
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	h := wr.Header()
+	name, modTime, size := readerInfo(r)
+	if cd := h.Get("Content-Disposition"); cd == "" {
+		if name == "" {
+			name = "file"
+		}
+		h.Set("Content-Disposition", contentDisposition("attachment", name))
+	} else if _, params, err := mime.ParseMediaType(cd); err == nil && params["filename"] != "" {
+		name = params["filename"]
+	}
+	if t, err := http.ParseTime(h.Get("Last-Modified")); err == nil {
+		modTime = t
+	}
+
+	if rs := seekable(r, size); rs != nil && (status == 0 || status == http.StatusOK) &&
+		(req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		http.ServeContent(wr, req, name, modTime, rs)
+		return
+	}
+
+	if size >= 0 && h.Get("Content-Length") == "" {
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if !modTime.IsZero() && h.Get("Last-Modified") == "" {
+		h.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if status != 0 {
+		wr.WriteHeader(status)
+	}
+	io.Copy(wr, r)
+}
+
+// readerInfo returns what r knows about itself: the name and modification time
+// of a file, and its size, or -1 if unknown.
+func readerInfo(r io.Reader) (name string, modTime time.Time, size int64) {
+	size = -1
+	switch r := r.(type) {
+	case interface{ Stat() (fs.FileInfo, error) }:
+		if info, err := r.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Name(), info.ModTime(), info.Size()
+		}
+	case interface{ Size() int64 }:
+		size = r.Size()
+	}
+	return name, modTime, size
+}
+
+// seekable returns r as an io.ReadSeeker, or nil if it can't be served in ranges.
+func seekable(r io.Reader, size int64) io.ReadSeeker {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		return rs
+	}
+	if ra, ok := r.(io.ReaderAt); ok && size >= 0 {
+		return io.NewSectionReader(ra, 0, size)
+	}
+	return nil
+}
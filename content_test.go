@@ -0,0 +1,187 @@
+package wepi
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// onlyReaderAt hides every method of its reader but ReadAt, Read and Size.
+type onlyReaderAt struct {
+	io.Reader
+	ra   io.ReaderAt
+	size int64
+}
+
+func (o onlyReaderAt) ReadAt(p []byte, off int64) (int, error) { return o.ra.ReadAt(p, off) }
+func (o onlyReaderAt) Size() int64                             { return o.size }
+
+func getRange(w *WepiController, path, rangeHeader string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+	return rr
+}
+
+func TestReader_NilCustomResponse(t *testing.T) {
+	w := Get()
+	AddGET(w, "/stream", func(params ParamsManager, req *http.Request) (io.Reader, *CustomResponse, error) {
+		return io.MultiReader(strings.NewReader("plain ")), nil, nil
+	})
+
+	rr := get(w, "/stream")
+	if rr.Code != http.StatusOK || rr.Body.String() != "plain " {
+		t.Fatalf("status = %d, body = %q", rr.Code, rr.Body.String())
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != `attachment; filename=file` {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+	if rr.Header().Get("Accept-Ranges") != "" {
+		t.Errorf("a reader that can't seek advertised ranges")
+	}
+}
+
+func TestReader_Range(t *testing.T) {
+	w := Get()
+	AddGET(w, "/data", func(params ParamsManager, req *http.Request) (io.Reader, *CustomResponse, error) {
+		return strings.NewReader("0123456789"), nil, nil
+	})
+
+	rr := getRange(w, "/data", "")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Length") != "10" || rr.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("full: status = %d, headers = %v", rr.Code, rr.Header())
+	}
+
+	rr = getRange(w, "/data", "bytes=2-5")
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "2345" {
+		t.Fatalf("range: status = %d, body = %q, want 206 2345", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Content-Range") != "bytes 2-5/10" {
+		t.Errorf("Content-Range = %q", rr.Header().Get("Content-Range"))
+	}
+
+	if rr := getRange(w, "/data", "bytes=20-"); rr.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("unsatisfiable: status = %d, want 416", rr.Code)
+	}
+}
+
+func TestReader_MultipartRanges(t *testing.T) {
+	w := Get()
+	AddGET(w, "/data", func(params ParamsManager, req *http.Request) (io.Reader, *CustomResponse, error) {
+		return onlyReaderAt{Reader: strings.NewReader("0123456789"), ra: strings.NewReader("0123456789"), size: 10}, nil, nil
+	})
+
+	rr := getRange(w, "/data", "bytes=0-1,7-8")
+	if rr.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", rr.Code)
+	}
+	mediaType, params, err := mime.ParseMediaType(rr.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q", rr.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(rr.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		b, _ := io.ReadAll(p)
+		parts = append(parts, p.Header.Get("Content-Range")+"="+string(b))
+	}
+	if strings.Join(parts, ",") != "bytes 0-1/10=01,bytes 7-8/10=78" {
+		t.Errorf("parts = %v", parts)
+	}
+}
+
+func TestReader_FileNameAndLastModified(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.csv")
+	if err := os.WriteFile(path, []byte("a,b\n1,2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	w := Get()
+	AddGET(w, "/report", func(params ParamsManager, req *http.Request) (io.Reader, *CustomResponse, error) {
+		f, err := os.Open(path)
+		return f, nil, err
+	})
+
+	rr := get(w, "/report")
+	if rr.Code != http.StatusOK || rr.Body.String() != "a,b\n1,2\n" {
+		t.Fatalf("status = %d, body = %q", rr.Code, rr.Body.String())
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != "attachment; filename=report.csv" {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("Content-Type = %q, want text/csv from the file name", ct)
+	}
+	if lm := rr.Header().Get("Last-Modified"); lm != "Wed, 01 May 2024 12:00:00 GMT" {
+		t.Errorf("Last-Modified = %q", lm)
+	}
+
+	if rr := getRange(w, "/report", "", "If-Modified-Since", modified.Format(http.TimeFormat)); rr.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: status = %d, want 304", rr.Code)
+	}
+}
+
+func TestReader_IfRange(t *testing.T) {
+	w := Get()
+	AddGET(w, "/data", func(params ParamsManager, req *http.Request) (io.Reader, *CustomResponse, error) {
+		return bytes.NewReader([]byte("0123456789")), Custom().SetETag("v1").Inline("data.bin"), nil
+	})
+
+	if rr := getRange(w, "/data", "bytes=0-3", "If-Range", `"v1"`); rr.Code != http.StatusPartialContent || rr.Body.String() != "0123" {
+		t.Errorf("current If-Range: status = %d, body = %q, want 206", rr.Code, rr.Body.String())
+	}
+	rr := getRange(w, "/data", "bytes=0-3", "If-Range", `"v0"`)
+	if rr.Code != http.StatusOK || rr.Body.String() != "0123456789" {
+		t.Errorf("stale If-Range: status = %d, body = %q, want the full body", rr.Code, rr.Body.String())
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != "inline; filename=data.bin" {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+}
+
+func TestReader_CustomStatusSkipsRanges(t *testing.T) {
+	w := Get()
+	AddGET(w, "/data", func(params ParamsManager, req *http.Request) (io.Reader, *CustomResponse, error) {
+		return strings.NewReader("0123456789"), Custom().SetStatus(http.StatusAccepted), nil
+	})
+
+	rr := getRange(w, "/data", "bytes=2-5")
+	if rr.Code != http.StatusAccepted || rr.Body.String() != "0123456789" || rr.Header().Get("Content-Length") != "10" {
+		t.Errorf("status = %d, body = %q, Content-Length = %q", rr.Code, rr.Body.String(), rr.Header().Get("Content-Length"))
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	if got := contentDisposition("attachment", "my report.pdf"); got != `attachment; filename="my report.pdf"` {
+		t.Errorf("got %q", got)
+	}
+	if got := contentDisposition("attachment", "résumé.pdf"); got != `attachment; filename*=utf-8''r%C3%A9sum%C3%A9.pdf` {
+		t.Errorf("got %q", got)
+	}
+	if got := contentDisposition("inline", ""); got != "inline" {
+		t.Errorf("got %q", got)
+	}
+}
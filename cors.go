@@ -1,48 +1,279 @@
 package wepi
 
-import "net/http"
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
 
-// optionsInterceptor handles CORS preflight (OPTIONS) requests.
-func (wep *WepiController) optionsInterceptor(path string, w http.ResponseWriter, req *http.Request) bool {
-	if len(wep.cors) == 0 {
+// DefaultCORSAllowedHeaders are the request headers allowed when CORSConfig.AllowedHeaders is nil.
+var DefaultCORSAllowedHeaders = []string{"Content-Type", "Authorization", "X-Requested-With"}
+
+// CORSConfig configures cross-origin requests. An origin is allowed if it is listed
+// in AllowedOrigins, matches one of AllowedOriginPatterns or AllowOriginFunc accepts it.
+type CORSConfig struct {
+	AllowedOrigins        []string                                    // exact origins, "https://*.example.com" subdomain wildcards, or "*" for any
+	AllowedOriginPatterns []*regexp.Regexp                            // each must match the whole origin
+	AllowOriginFunc       func(origin string, req *http.Request) bool // decides dynamically, e.g. from a database
+	AllowedHeaders        []string                                    // DefaultCORSAllowedHeaders if nil; "*" allows any requested header
+	ExposedHeaders        []string                                    // response headers readable by the browser
+	AllowCredentials      bool                                        // send Access-Control-Allow-Credentials: true
+	MaxAge                time.Duration                               // how long browsers may cache a preflight; omitted if 0
+}
+
+// corsPolicy is a CORSConfig prepared for lookups.
+type corsPolicy struct {
+	config    CORSConfig
+	origins   map[string]bool
+	wildcards []originWildcard
+	patterns  []*regexp.Regexp
+	any       bool
+}
+
+// originWildcard matches "https://*.example.com": the scheme, then one or more
+// subdomain labels, then the domain.
+type originWildcard struct {
+	prefix, suffix string
+}
+
+func (o originWildcard) match(origin string) bool {
+	if len(origin) <= len(o.prefix)+len(o.suffix) || !strings.HasPrefix(origin, o.prefix) || !strings.HasSuffix(origin, o.suffix) {
 		return false
 	}
-
-	if req.Method != http.MethodOptions {
+	sub := origin[len(o.prefix) : len(origin)-len(o.suffix)]
+	if sub[0] == '.' || sub[len(sub)-1] == '.' {
 		return false
 	}
+	for i := 0; i < len(sub); i++ {
+		c := sub[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
 
-	// Check if path has a registered GET or POST route
-	returnCors := false
-	pathFound, _, _ := wep.loadRouteFromRequest(path, http.MethodGet)
-	if pathFound != "" {
-		returnCors = true
+func (w *WepiController) newCORSPolicy(config CORSConfig) *corsPolicy {
+	if config.AllowedHeaders == nil {
+		config.AllowedHeaders = DefaultCORSAllowedHeaders
+	}
+	p := &corsPolicy{config: config, origins: make(map[string]bool)}
+	for _, o := range config.AllowedOrigins {
+		w.addOrigin(p, o)
 	}
-	if !returnCors {
-		pathFound, _, _ = wep.loadRouteFromRequest(path, http.MethodPost)
-		if pathFound != "" {
-			returnCors = true
+	for _, re := range config.AllowedOriginPatterns {
+		p.patterns = append(p.patterns, regexp.MustCompile(`^(?:`+re.String()+`)$`))
+	}
+	return p
+}
+
+func (w *WepiController) addOrigin(p *corsPolicy, origin string) {
+	switch {
+	case origin == "*" && p.config.AllowCredentials:
+		if w == nil {
+			return // route built in a RouteSet; nothing to log to yet
 		}
+		w.cfg().logger.Warn("cors: ignoring \"*\" origin together with AllowCredentials; list the allowed origins instead")
+	case origin == "*":
+		p.any = true
+	case strings.Contains(origin, "://*."):
+		scheme, domain, _ := strings.Cut(origin, "*")
+		p.wildcards = append(p.wildcards, originWildcard{prefix: scheme, suffix: domain})
+	default:
+		p.origins[origin] = true
 	}
+}
+
+// SetCORS replaces the CORS configuration of the controller. A "*" origin is
+// refused when AllowCredentials is set, since any site could then make
+// credentialed requests.
+func (w *WepiController) SetCORS(config CORSConfig) {
+	p := w.newCORSPolicy(config)
+	w.update(func(s *settings) { s.cors = p })
+}
 
-	if returnCors {
-		if wep.isOriginAllowed(req.Header.Get("Origin")) {
-			w.Header().Set("Access-Control-Allow-Origin", req.Header.Get("Origin"))
-			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
-			w.WriteHeader(http.StatusNoContent)
-			return true
+// AddAllowedCORS allows one more origin ("*" for any), keeping the rest of the configuration.
+func (w *WepiController) AddAllowedCORS(cors string) {
+	w.update(func(s *settings) {
+		config := CORSConfig{}
+		if s.cors != nil {
+			config = s.cors.config
 		}
+		config.AllowedOrigins = append(slices.Clip(config.AllowedOrigins), cors)
+		s.cors = w.newCORSPolicy(config)
+	})
+}
+
+// CORS gives the route its own CORS policy, replacing the group and controller ones.
+func (r *Route) CORS(config CORSConfig) *Route {
+	p := r.controller.newCORSPolicy(config)
+	return r.update(func(r *Route) { r.cors = p })
+}
+
+// CORS gives the routes of the group their own CORS policy, replacing the
+// controller one. When groups are nested, the longest prefix wins.
+func (g *RouteGroup) CORS(config CORSConfig) *RouteGroup {
+	p := g.controller.newCORSPolicy(config)
+	return g.update(func(g *RouteGroup) { g.cors = p })
+}
+
+// corsPolicyFor resolves the CORS policy of route: its own, its group's, or the controller's.
+func (w *WepiController) corsPolicyFor(route *Route) *corsPolicy {
+	if route.cors != nil {
+		return route.cors
+	}
+	s := w.cfg()
+	var group *RouteGroup
+	for _, g := range s.groups {
+		if g.cors != nil && g.contains(route.route) && (group == nil || len(g.prefix) > len(group.prefix)) {
+			group = g
+		}
+	}
+	if group != nil {
+		return group.cors
 	}
+	return s.cors
+}
 
-	return false
+// corsMethods are the methods a preflight can ask about, with the method of the route serving them.
+var corsMethods = []struct{ method, route string }{
+	{http.MethodGet, http.MethodGet},
+	{http.MethodPost, http.MethodPost},
+	{http.MethodPut, http.MethodPost}, // PUT is served by POST routes
 }
 
-// isOriginAllowed checks if the given origin is in the CORS allow list.
-func (w *WepiController) isOriginAllowed(origin string) bool {
-	ok := w.cors[origin]
-	if !ok && w.cors["*"] {
+// preflightTarget finds the routes registered on path. It returns the methods
+// they serve and the route the preflight asks about: the one for
+// Access-Control-Request-Method, or the first one found if that isn't served.
+func (w *WepiController) preflightTarget(path string, requested string) (methods []string, target *Route) {
+	for _, m := range corsMethods {
+		found, route, _ := w.loadRouteFromRequest(path, m.route)
+		if found == "" {
+			continue
+		}
+		methods = append(methods, m.method)
+		if target == nil || m.method == requested {
+			target = route
+		}
+	}
+	return methods, target
+}
+
+// optionsInterceptor handles CORS preflight requests with the policy of the route they
+// target. A preflight is an OPTIONS request with both Origin and
+// Access-Control-Request-Method; other OPTIONS requests, and preflights for paths
+// without routes or without a CORS policy, fall through. Preflights the policy
+// refuses are answered with 403.
+func (wep *WepiController) optionsInterceptor(path string, w http.ResponseWriter, req *http.Request) bool {
+	if req.Method != http.MethodOptions || req.Header.Get("Origin") == "" || req.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+
+	methods, route := wep.preflightTarget(path, req.Header.Get("Access-Control-Request-Method"))
+	if route == nil {
+		return false
+	}
+	policy := wep.corsPolicyFor(route)
+	if policy == nil {
+		return false
+	}
+
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	origin := req.Header.Get("Origin")
+	allowHeaders, reason := policy.checkPreflight(origin, methods, req)
+	if reason != "" {
+		wep.logDebug(req.Context(), "cors preflight denied", "path", path, "origin", origin, "reason", reason)
+		w.WriteHeader(http.StatusForbidden)
 		return true
 	}
-	return ok
+
+	header.Set("Access-Control-Allow-Origin", policy.allowOrigin(origin, req))
+	header.Set("Access-Control-Allow-Methods", strings.Join(append(methods, http.MethodOptions), ", "))
+	if allowHeaders != "" {
+		header.Set("Access-Control-Allow-Headers", allowHeaders)
+	}
+	if policy.config.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if policy.config.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(policy.config.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// checkPreflight validates a preflight against the policy. It returns the value of
+// Access-Control-Allow-Headers, or why the preflight is refused.
+func (p *corsPolicy) checkPreflight(origin string, methods []string, req *http.Request) (allowHeaders string, reason string) {
+	if p.allowOrigin(origin, req) == "" {
+		return "", "origin not allowed"
+	}
+
+	if method := req.Header.Get("Access-Control-Request-Method"); !slices.Contains(methods, method) {
+		return "", "method " + method + " not allowed"
+	}
+
+	requested := req.Header.Get("Access-Control-Request-Headers")
+	if slices.Contains(p.config.AllowedHeaders, "*") {
+		return requested, ""
+	}
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" && !slices.ContainsFunc(p.config.AllowedHeaders, func(a string) bool { return strings.EqualFold(a, h) }) {
+			return "", "header " + h + " not allowed"
+		}
+	}
+	return strings.Join(p.config.AllowedHeaders, ", "), ""
+}
+
+// setResponseHeaders adds the CORS headers of an actual (non-preflight) request.
+func (p *corsPolicy) setResponseHeaders(wr http.ResponseWriter, req *http.Request) {
+	wr.Header().Add("Vary", "Origin")
+	allow := p.allowOrigin(req.Header.Get("Origin"), req)
+	if allow == "" {
+		return
+	}
+
+	wr.Header().Set("Access-Control-Allow-Origin", allow)
+	if p.config.AllowCredentials {
+		wr.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(p.config.ExposedHeaders) > 0 {
+		wr.Header().Set("Access-Control-Expose-Headers", strings.Join(p.config.ExposedHeaders, ", "))
+	}
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin, or "" if it
+// isn't allowed. Origins allowed only through "*" get "*" rather than being reflected.
+func (p *corsPolicy) allowOrigin(origin string, req *http.Request) string {
+	if origin == "" {
+		return ""
+	}
+	if p.origins[origin] {
+		return origin
+	}
+	for _, wc := range p.wildcards {
+		if wc.match(origin) {
+			return origin
+		}
+	}
+	for _, re := range p.patterns {
+		if re.MatchString(origin) {
+			return origin
+		}
+	}
+	if p.config.AllowOriginFunc != nil && p.config.AllowOriginFunc(origin, req) {
+		return origin
+	}
+	if p.any {
+		return "*"
+	}
+	return ""
 }
@@ -3,27 +3,40 @@ package wepi
 import (
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"slices"
 	"testing"
+	"time"
 )
 
-func TestIsOriginAllowed(t *testing.T) {
+func originRequest(origin string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Origin", origin)
+	return req
+}
+
+func allowsOrigin(p *corsPolicy, req *http.Request) bool {
+	return p.allowOrigin(req.Header.Get("Origin"), req) != ""
+}
+
+func TestAllowOrigin(t *testing.T) {
 	w := Get()
 	w.AddAllowedCORS("https://example.com")
 
-	if !w.isOriginAllowed("https://example.com") {
+	if !allowsOrigin(w.cfg().cors, originRequest("https://example.com")) {
 		t.Error("expected exact origin to be allowed")
 	}
-	if w.isOriginAllowed("https://other.com") {
+	if allowsOrigin(w.cfg().cors, originRequest("https://other.com")) {
 		t.Error("expected non-listed origin to be rejected")
 	}
 }
 
-func TestIsOriginAllowed_Wildcard(t *testing.T) {
+func TestAllowOrigin_Wildcard(t *testing.T) {
 	w := Get()
 	w.AddAllowedCORS("*")
 
-	if !w.isOriginAllowed("https://anything.com") {
-		t.Error("expected any origin to be allowed with wildcard")
+	if got := w.cfg().cors.allowOrigin("https://anything.com", originRequest("https://anything.com")); got != "*" {
+		t.Errorf("allowOrigin = %q, want * for any origin with wildcard", got)
 	}
 }
 
@@ -37,6 +50,7 @@ func TestOptionsInterceptor_ValidPreflight(t *testing.T) {
 
 	req := httptest.NewRequest(http.MethodOptions, "/api/data", nil)
 	req.Header.Set("Origin", "https://example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
 	rr := httptest.NewRecorder()
 
 	handled := w.optionsInterceptor("/api/data", rr, req)
@@ -61,10 +75,330 @@ func TestOptionsInterceptor_DisallowedOrigin(t *testing.T) {
 
 	req := httptest.NewRequest(http.MethodOptions, "/api/data", nil)
 	req.Header.Set("Origin", "https://evil.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
 	rr := httptest.NewRecorder()
 
 	handled := w.optionsInterceptor("/api/data", rr, req)
+	if !handled {
+		t.Fatal("expected denied preflight to be handled")
+	}
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Allow-Origin = %q, want none", got)
+	}
+}
+
+func preflight(w *WepiController, path, origin, method, headers string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodOptions, path, nil)
+	req.Header.Set("Origin", origin)
+	if method != "" {
+		req.Header.Set("Access-Control-Request-Method", method)
+	}
+	if headers != "" {
+		req.Header.Set("Access-Control-Request-Headers", headers)
+	}
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+	return rr
+}
+
+func TestSetCORS_PreflightHeaders(t *testing.T) {
+	w := Get()
+	w.SetCORS(CORSConfig{
+		AllowedOrigins:   []string{"https://app.example"},
+		AllowedHeaders:   []string{"Content-Type", "X-Api-Key"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	AddGET(w, "/items", okHandler)
+
+	rr := preflight(w, "/items", "https://app.example", "GET", "x-api-key")
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusNoContent)
+	}
+	want := map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example",
+		"Access-Control-Allow-Methods":     "GET, OPTIONS",
+		"Access-Control-Allow-Headers":     "Content-Type, X-Api-Key",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "600",
+	}
+	for k, v := range want {
+		if got := rr.Header().Get(k); got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+	if !slices.Contains(rr.Header().Values("Vary"), "Origin") {
+		t.Errorf("Vary = %v, want Origin", rr.Header().Values("Vary"))
+	}
+}
+
+func TestSetCORS_MethodsFromRoutes(t *testing.T) {
+	w := Get()
+	w.AddAllowedCORS("*")
+	AddGET(w, "/items", okHandler)
+	AddJsonPOST(w, "/items", func(st tenantInput, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	})
+	AddGET(w, "/report", okHandler)
+
+	rr := preflight(w, "/items", "https://a.example", "PUT", "")
+	if got := rr.Header().Get("Access-Control-Allow-Methods"); got != "GET, POST, PUT, OPTIONS" {
+		t.Errorf("Allow-Methods = %q", got)
+	}
+
+	rr = preflight(w, "/report", "https://a.example", "POST", "")
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("POST preflight on GET-only route: status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestSetCORS_DeniesUnlistedHeader(t *testing.T) {
+	w := Get()
+	w.AddAllowedCORS("https://app.example")
+	AddGET(w, "/items", okHandler)
+
+	rr := preflight(w, "/items", "https://app.example", "GET", "X-Secret")
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestSetCORS_UnknownPathFallsThrough(t *testing.T) {
+	w := Get()
+	w.AddAllowedCORS("*")
+
+	req := httptest.NewRequest(http.MethodOptions, "/missing", nil)
+	req.Header.Set("Origin", "https://a.example")
+	handled, _ := w.Run("", req, httptest.NewRecorder())
 	if handled {
-		t.Error("expected OPTIONS to not be handled for disallowed origin")
+		t.Error("preflight for unknown path reported as handled")
+	}
+}
+
+func TestSetCORS_ActualRequestHeaders(t *testing.T) {
+	w := Get()
+	w.SetCORS(CORSConfig{
+		AllowedOrigins:   []string{"https://app.example"},
+		ExposedHeaders:   []string{"X-Total-Count"},
+		AllowCredentials: true,
+	})
+	AddGET(w, "/items", okHandler)
+
+	req := httptest.NewRequest(http.MethodGet, "/items", nil)
+	req.Header.Set("Origin", "https://app.example")
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+
+	if got := rr.Header().Get("Access-Control-Expose-Headers"); got != "X-Total-Count" {
+		t.Errorf("Expose-Headers = %q", got)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Allow-Credentials = %q", got)
+	}
+	if got := rr.Header().Get("Vary"); got != "Origin" {
+		t.Errorf("Vary = %q, want Origin", got)
+	}
+}
+
+func TestAllowOrigin_SubdomainWildcard(t *testing.T) {
+	w := Get()
+	w.AddAllowedCORS("https://*.example.com")
+
+	allowed := []string{"https://acme.example.com", "https://eu.acme.example.com"}
+	denied := []string{"https://example.com", "http://acme.example.com", "https://evil.com/.example.com", "https://acme.example.com.evil.com", "https://acme.example.com:8443"}
+	for _, o := range allowed {
+		if !allowsOrigin(w.cfg().cors, originRequest(o)) {
+			t.Errorf("%s: expected allowed", o)
+		}
+	}
+	for _, o := range denied {
+		if allowsOrigin(w.cfg().cors, originRequest(o)) {
+			t.Errorf("%s: expected denied", o)
+		}
+	}
+}
+
+func TestAllowOrigin_PatternAndFunc(t *testing.T) {
+	w := Get()
+	w.SetCORS(CORSConfig{
+		AllowedOriginPatterns: []*regexp.Regexp{regexp.MustCompile(`https://pr-\d+\.preview\.example\.dev`)},
+		AllowOriginFunc: func(origin string, req *http.Request) bool {
+			return origin == "https://customer.example" && req.Header.Get("X-Tenant") != ""
+		},
+	})
+
+	if !allowsOrigin(w.cfg().cors, originRequest("https://pr-42.preview.example.dev")) {
+		t.Error("expected pattern origin to be allowed")
+	}
+	if allowsOrigin(w.cfg().cors, originRequest("https://pr-42.preview.example.dev.evil.com")) {
+		t.Error("pattern must match the whole origin")
+	}
+
+	req := originRequest("https://customer.example")
+	if allowsOrigin(w.cfg().cors, req) {
+		t.Error("func origin allowed without tenant header")
+	}
+	req.Header.Set("X-Tenant", "acme")
+	if !allowsOrigin(w.cfg().cors, req) {
+		t.Error("expected func origin to be allowed")
+	}
+}
+
+func TestCORS_WildcardOriginNotReflected(t *testing.T) {
+	w := Get()
+	w.AddAllowedCORS("*")
+	AddGET(w, "/items", okHandler)
+
+	rr := preflight(w, "/items", "https://a.example", "GET", "")
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Allow-Origin = %q, want *", got)
+	}
+}
+
+func TestCORS_WildcardRefusedWithCredentials(t *testing.T) {
+	w := Get()
+	w.SetCORS(CORSConfig{AllowedOrigins: []string{"*", "https://app.example"}, AllowCredentials: true})
+	AddGET(w, "/items", okHandler)
+
+	rr := preflight(w, "/items", "https://evil.example", "GET", "")
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Allow-Origin = %q, want none", got)
+	}
+
+	rr = preflight(w, "/items", "https://app.example", "GET", "")
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+		t.Errorf("listed origin: Allow-Origin = %q", got)
+	}
+}
+
+func TestRouteCORS_OverridesController(t *testing.T) {
+	w := Get()
+	w.AddAllowedCORS("*")
+	AddGET(w, "/public", okHandler)
+	AddGET(w, "/dashboard", okHandler).CORS(CORSConfig{
+		AllowedOrigins:   []string{"https://dash.example"},
+		AllowCredentials: true,
+	})
+
+	rr := preflight(w, "/public", "https://any.example", "GET", "")
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("public: Allow-Origin = %q, want *", got)
+	}
+
+	rr = preflight(w, "/dashboard", "https://any.example", "GET", "")
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("dashboard, other origin: status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+
+	rr = preflight(w, "/dashboard", "https://dash.example", "GET", "")
+	if got := rr.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("dashboard: Allow-Credentials = %q, want true", got)
+	}
+}
+
+func TestGroupCORS_LongestPrefixWins(t *testing.T) {
+	w := Get()
+	w.Group("/api").CORS(CORSConfig{AllowedOrigins: []string{"https://api.example"}})
+	w.Group("/api/admin").CORS(CORSConfig{AllowedOrigins: []string{"https://admin.example"}})
+	AddGET(w, "/api/items", okHandler)
+	AddGET(w, "/api/admin/users", okHandler)
+	AddGET(w, "/other", okHandler)
+
+	cases := []struct {
+		path, origin string
+		want         int
+	}{
+		{"/api/items", "https://api.example", http.StatusNoContent},
+		{"/api/items", "https://admin.example", http.StatusForbidden},
+		{"/api/admin/users", "https://admin.example", http.StatusNoContent},
+		{"/api/admin/users", "https://api.example", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		if rr := preflight(w, c.path, c.origin, "GET", ""); rr.Code != c.want {
+			t.Errorf("%s from %s: status = %d, want %d", c.path, c.origin, rr.Code, c.want)
+		}
+	}
+
+	// No policy applies outside the groups: the preflight falls through
+	req := httptest.NewRequest(http.MethodOptions, "/other", nil)
+	req.Header.Set("Origin", "https://api.example")
+	if handled, _ := w.Run("", req, httptest.NewRecorder()); handled {
+		t.Error("preflight without policy reported as handled")
+	}
+}
+
+func TestRouteCORS_PreflightTargetsRequestedMethod(t *testing.T) {
+	w := Get()
+	AddGET(w, "/items", okHandler).CORS(CORSConfig{AllowedOrigins: []string{"https://read.example"}})
+	AddJsonPOST(w, "/items", func(st tenantInput, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	}).CORS(CORSConfig{AllowedOrigins: []string{"https://write.example"}})
+
+	if rr := preflight(w, "/items", "https://write.example", "PUT", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("PUT from writer: status = %d, want %d", rr.Code, http.StatusNoContent)
+	}
+	if rr := preflight(w, "/items", "https://read.example", "POST", ""); rr.Code != http.StatusForbidden {
+		t.Errorf("POST from reader: status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/items", nil)
+	req.Header.Set("Origin", "https://read.example")
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://read.example" {
+		t.Errorf("GET: Allow-Origin = %q", got)
+	}
+}
+
+func TestCORSPolicyFor(t *testing.T) {
+	w := Get()
+	w.AddAllowedCORS("https://app.example")
+	w.Group("/partners").CORS(CORSConfig{AllowedOrigins: []string{"https://partner.example"}})
+	w.Group("/partners/beta").CORS(CORSConfig{AllowedOrigins: []string{"https://beta.example"}})
+	plain := AddGET(w, "/items", okHandler)
+	grouped := AddGET(w, "/partners/items", okHandler)
+	nested := AddGET(w, "/partners/beta/items", okHandler)
+	own := AddGET(w, "/partners/own", okHandler).CORS(CORSConfig{AllowedOrigins: []string{"https://own.example"}})
+
+	for _, tc := range []struct {
+		route  *Route
+		origin string
+	}{
+		{plain, "https://app.example"},
+		{grouped, "https://partner.example"},
+		{nested, "https://beta.example"},
+		{own, "https://own.example"},
+	} {
+		p := w.corsPolicyFor(tc.route.published())
+		if !allowsOrigin(p, originRequest(tc.origin)) {
+			t.Errorf("%s: %s not allowed", tc.route.route, tc.origin)
+		}
+		if tc.origin != "https://app.example" && allowsOrigin(p, originRequest("https://app.example")) {
+			t.Errorf("%s: controller origin allowed despite a more specific policy", tc.route.route)
+		}
+	}
+}
+
+func TestOptionsInterceptor_NotAPreflight(t *testing.T) {
+	w := Get()
+	w.AddAllowedCORS("https://example.com")
+	AddGET(w, "/api/data", okHandler)
+
+	noOrigin := httptest.NewRequest(http.MethodOptions, "/api/data", nil)
+	noOrigin.Header.Set("Access-Control-Request-Method", "GET")
+	noMethod := originRequest("https://example.com")
+	noMethod.Method = http.MethodOptions
+	for name, req := range map[string]*http.Request{"without Origin": noOrigin, "without Access-Control-Request-Method": noMethod} {
+		rr := httptest.NewRecorder()
+		if w.optionsInterceptor("/api/data", rr, req) {
+			t.Errorf("OPTIONS %s handled as a preflight: %d", name, rr.Code)
+		}
 	}
 }
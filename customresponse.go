@@ -48,3 +48,24 @@ func (c *CustomResponse) SetHeader(key string, value string) *CustomResponse {
 	c.headers.Set(key, value)
 	return c
 }
+
+// Status returns the status set on the response, or 0 if none was set.
+func (c *CustomResponse) Status() int {
+	return c.status
+}
+
+// Body returns the body set on the response.
+func (c *CustomResponse) Body() []byte {
+	return c.body
+}
+
+// Header returns the first value of the header key set on the response.
+func (c *CustomResponse) Header(key string) string {
+	return c.headers.Get(key)
+}
+
+// DelHeader removes the header key from the response.
+func (c *CustomResponse) DelHeader(key string) *CustomResponse {
+	c.headers.Del(key)
+	return c
+}
@@ -28,3 +28,20 @@ func TestCustomResponse_AddHeader(t *testing.T) {
 		t.Errorf("X-Test values = %v, want [val1 val2]", vals)
 	}
 }
+
+func TestCustomResponse_Getters(t *testing.T) {
+	c := Custom().SetStatus(201).SetBodyString("ok").SetHeader("X-A", "1").SetHeader("X-B", "2").DelHeader("X-B")
+
+	if c.Status() != 201 {
+		t.Errorf("Status() = %d, want 201", c.Status())
+	}
+	if string(c.Body()) != "ok" {
+		t.Errorf("Body() = %q, want ok", c.Body())
+	}
+	if c.Header("X-A") != "1" || c.Header("X-B") != "" {
+		t.Errorf("headers X-A=%q X-B=%q, want 1 and empty", c.Header("X-A"), c.Header("X-B"))
+	}
+	if Custom().Header("X-Missing") != "" {
+		t.Error("expected empty header on a fresh response")
+	}
+}
@@ -0,0 +1,119 @@
+package wepi
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxDecompressedSize bounds decompressed request bodies unless SetMaxDecompressedSize says otherwise.
+const DefaultMaxDecompressedSize = 10 << 20
+
+// ErrBodyTooLarge is returned while reading a request body that exceeds its limit;
+// the request is answered with 413.
+var ErrBodyTooLarge = errors.New("wepi: request body too large")
+
+// errUnsupportedEncoding marks request bodies answered with 415.
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// SetMaxDecompressedSize bounds the size of gzip/deflate request bodies once
+// decompressed (DefaultMaxDecompressedSize by default), so a small compressed
+// body can't expand without limit.
+func (w *WepiController) SetMaxDecompressedSize(n int64) {
+	w.update(func(s *settings) { s.maxDecompressedSize = n })
+}
+
+// decompressRequest replaces the body of a request sent with Content-Encoding
+// gzip or deflate by its decompressed form, so decoders read plain bytes.
+func (w *WepiController) decompressRequest(req *http.Request) error {
+	header := req.Header.Get("Content-Encoding")
+	if header == "" || req.Method == http.MethodGet || req.Body == nil {
+		return nil
+	}
+
+	limit := w.cfg().maxDecompressedSize
+	if limit == 0 {
+		limit = DefaultMaxDecompressedSize
+	}
+
+	// Encodings are listed in the order they were applied, so undo them from the last
+	encodings := strings.Split(header, ",")
+	body := io.Reader(req.Body)
+	for i := len(encodings) - 1; i >= 0; i-- {
+		var err error
+		switch enc := strings.ToLower(strings.TrimSpace(encodings[i])); enc {
+		case "gzip", "x-gzip":
+			body, err = gzip.NewReader(body)
+		case "deflate":
+			body, err = newDeflateReader(body)
+		case "identity", "":
+		default:
+			return fmt.Errorf("%w: %s", errUnsupportedEncoding, enc)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{&maxReader{r: body, n: limit}, req.Body}
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-Length")
+	req.ContentLength = -1
+	return nil
+}
+
+// newDeflateReader reads "deflate" bodies, which HTTP defines as zlib but some
+// clients send as raw deflate.
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// maxReader fails with ErrBodyTooLarge once more than n bytes are read.
+type maxReader struct {
+	r io.Reader
+	n int64
+}
+
+func (m *maxReader) Read(p []byte) (int, error) {
+	if m.n < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	if int64(len(p)) > m.n+1 {
+		p = p[:m.n+1]
+	}
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	if m.n < 0 {
+		return n, ErrBodyTooLarge
+	}
+	return n, err
+}
+
+// bodyErrorStatus picks the status answering a request whose body couldn't be read.
+func bodyErrorStatus(err error) int {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errUnsupportedEncoding):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrBodyTooLarge), errors.As(err, &maxErr):
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
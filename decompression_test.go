@@ -0,0 +1,135 @@
+package wepi
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func gzipBytes(s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.Bytes()
+}
+
+func postEncoded(w *WepiController, path, contentType, encoding string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Encoding", encoding)
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+	return rr
+}
+
+func echoTenant(st tenantInput, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+	return st.TenantID + "/" + st.Name, nil, nil
+}
+
+func TestDecompress_GzipJSON(t *testing.T) {
+	w := Get()
+	AddJsonPOST(w, "/sync", echoTenant)
+
+	rr := postEncoded(w, "/sync", "application/json", "gzip", gzipBytes(`{"tenant_id":"acme","name":"phone"}`))
+	if rr.Code != http.StatusOK || rr.Body.String() != "acme/phone" {
+		t.Errorf("got %d %q, want 200 acme/phone", rr.Code, rr.Body.String())
+	}
+}
+
+func TestDecompress_DeflateZlibAndRaw(t *testing.T) {
+	w := Get()
+	AddJsonPOST(w, "/sync", echoTenant)
+	body := `{"tenant_id":"acme","name":"tablet"}`
+
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write([]byte(body))
+	zw.Close()
+
+	var raw bytes.Buffer
+	fw, _ := flate.NewWriter(&raw, flate.DefaultCompression)
+	fw.Write([]byte(body))
+	fw.Close()
+
+	for name, b := range map[string][]byte{"zlib": z.Bytes(), "raw": raw.Bytes()} {
+		rr := postEncoded(w, "/sync", "application/json", "deflate", b)
+		if rr.Body.String() != "acme/tablet" {
+			t.Errorf("%s deflate: got %d %q", name, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestDecompress_Form(t *testing.T) {
+	w := Get()
+	AddFormPost(w, "/form", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return params.GetString("name", ""), nil, nil
+	})
+
+	form := url.Values{"name": {"zipped"}}.Encode()
+	rr := postEncoded(w, "/form", "application/x-www-form-urlencoded", "gzip", gzipBytes(form))
+	if rr.Body.String() != "zipped" {
+		t.Errorf("got %d %q, want zipped", rr.Code, rr.Body.String())
+	}
+}
+
+func TestDecompress_UnsupportedEncoding(t *testing.T) {
+	w := Get()
+	called := false
+	AddJsonPOST(w, "/sync", func(st tenantInput, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		called = true
+		return "", nil, nil
+	})
+
+	rr := postEncoded(w, "/sync", "application/json", "br", []byte("whatever"))
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusUnsupportedMediaType)
+	}
+	if got := rr.Header().Get("Accept-Encoding"); got != "gzip, deflate" {
+		t.Errorf("Accept-Encoding = %q", got)
+	}
+	if called {
+		t.Error("handler ran for an unsupported encoding")
+	}
+}
+
+func TestDecompress_ZipBomb(t *testing.T) {
+	w := Get()
+	w.SetMaxDecompressedSize(1 << 10)
+	AddJsonPOST(w, "/sync", echoTenant)
+
+	bomb := `{"tenant_id":"` + strings.Repeat("a", 1<<20) + `"}`
+	rr := postEncoded(w, "/sync", "application/json", "gzip", gzipBytes(bomb))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestDecompress_CorruptBody(t *testing.T) {
+	w := Get()
+	AddJsonPOST(w, "/sync", echoTenant)
+
+	rr := postEncoded(w, "/sync", "application/json", "gzip", []byte("not gzip at all"))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMaxReader(t *testing.T) {
+	atLimit := &maxReader{r: strings.NewReader("12345"), n: 5}
+	if b, err := io.ReadAll(atLimit); err != nil || string(b) != "12345" {
+		t.Errorf("body at the limit: %q, %v", b, err)
+	}
+
+	over := &maxReader{r: strings.NewReader("123456"), n: 5}
+	if _, err := io.ReadAll(over); err != ErrBodyTooLarge {
+		t.Errorf("body over the limit: err = %v, want ErrBodyTooLarge", err)
+	}
+}
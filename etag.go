@@ -0,0 +1,179 @@
+package wepi
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ResourceVersion identifies the current state of the resource a route acts on.
+// Either field may be left empty.
+type ResourceVersion struct {
+	ETag         string // e.g. `"v42"`, or v42, which is quoted as a strong tag
+	LastModified time.Time
+}
+
+func (v ResourceVersion) exists() bool {
+	return v.ETag != "" || !v.LastModified.IsZero()
+}
+
+// EnableETags gives successful GET responses a weak ETag computed from their body,
+// unless the handler set one, and answers If-None-Match revalidations with 304.
+func (w *WepiController) EnableETags() {
+	w.update(func(s *settings) { s.autoETags = true })
+}
+
+// Preconditions makes the route check If-Match, If-Unmodified-Since, If-None-Match
+// and If-Modified-Since against the version current returns, after the middlewares
+// and before the handler. Failed preconditions answer 412 (or 304 for GET) without
+// running the handler, which gives write routes optimistic concurrency.
+func (r *Route) Preconditions(current func(params ParamsManager, req *http.Request) (ResourceVersion, error)) *Route {
+	return r.update(func(r *Route) { r.version = current })
+}
+
+// SetETag sets the ETag header. Unquoted tags are quoted as strong tags.
+func (c *CustomResponse) SetETag(tag string) *CustomResponse {
+	return c.SetHeader("ETag", formatETag(tag))
+}
+
+// SetLastModified sets the Last-Modified header.
+func (c *CustomResponse) SetLastModified(t time.Time) *CustomResponse {
+	return c.SetHeader("Last-Modified", t.UTC().Format(http.TimeFormat))
+}
+
+func formatETag(tag string) string {
+	if tag == "" || strings.HasPrefix(tag, `"`) || strings.HasPrefix(tag, `W/"`) {
+		return tag
+	}
+	return `"` + tag + `"`
+}
+
+// weakETag derives a weak ETag from a serialized body.
+func weakETag(body []byte) string {
+	h := fnv.New64a()
+	h.Write(body)
+	return `W/"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+// checkRouteVersion evaluates the request preconditions against the route's
+// current version. It returns the outcome answering a failed precondition, or nil.
+func checkRouteVersion(route *Route, params ParamsManager, wr http.ResponseWriter, req *http.Request) *Outcome {
+	v, err := route.version(params, req)
+	if err != nil {
+		return &Outcome{Err: err}
+	}
+	v.ETag = formatETag(v.ETag)
+
+	status := checkPreconditions(req, v)
+	if status == 0 {
+		if safeMethod(req.Method) {
+			setVersionHeaders(wr.Header(), v)
+		}
+		return nil
+	}
+	c := Custom().SetStatus(status)
+	if status == http.StatusNotModified {
+		if v.ETag != "" {
+			c.SetETag(v.ETag)
+		}
+		if !v.LastModified.IsZero() {
+			c.SetLastModified(v.LastModified)
+		}
+	}
+	return &Outcome{Custom: c}
+}
+
+func setVersionHeaders(h http.Header, v ResourceVersion) {
+	if v.ETag != "" {
+		h.Set("ETag", v.ETag)
+	}
+	if !v.LastModified.IsZero() {
+		h.Set("Last-Modified", v.LastModified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// conditionalResponse answers a successful GET whose body is ready with 304 or 412
+// when the request's preconditions ask for it, adding the automatic ETag first.
+// It reports whether it wrote the response.
+func (w *WepiController) conditionalResponse(wr http.ResponseWriter, req *http.Request, status int, body []byte) bool {
+	if (status != 0 && status != http.StatusOK) || !safeMethod(req.Method) {
+		return false
+	}
+
+	h := wr.Header()
+	if h.Get("ETag") == "" && w.cfg().autoETags {
+		h.Set("ETag", weakETag(body))
+	}
+	v := ResourceVersion{ETag: h.Get("ETag")}
+	if lm, err := http.ParseTime(h.Get("Last-Modified")); err == nil {
+		v.LastModified = lm
+	}
+
+	switch checkPreconditions(req, v) {
+	case http.StatusNotModified:
+		h.Del("Content-Type")
+		h.Del("Content-Length")
+		wr.WriteHeader(http.StatusNotModified)
+		return true
+	case http.StatusPreconditionFailed:
+		wr.WriteHeader(http.StatusPreconditionFailed)
+		return true
+	}
+	return false
+}
+
+// checkPreconditions evaluates conditional request headers against v in the
+// order of RFC 9110 section 13.2.2. It returns 304, 412 or 0 to proceed.
+func checkPreconditions(req *http.Request, v ResourceVersion) int {
+	if im := req.Header.Get("If-Match"); im != "" {
+		if !matchETag(im, v, true) {
+			return http.StatusPreconditionFailed
+		}
+	} else if t, err := http.ParseTime(req.Header.Get("If-Unmodified-Since")); err == nil && !v.LastModified.IsZero() {
+		if v.LastModified.Truncate(time.Second).After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if matchETag(inm, v, false) {
+			if safeMethod(req.Method) {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if t, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && safeMethod(req.Method) && !v.LastModified.IsZero() {
+		if !v.LastModified.Truncate(time.Second).After(t) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// matchETag reports whether the If-Match/If-None-Match list in header matches the
+// version, comparing strongly (weak tags never match) or weakly.
+func matchETag(header string, v ResourceVersion, strong bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return v.exists()
+	}
+	if v.ETag == "" || (strong && strings.HasPrefix(v.ETag, "W/")) {
+		return false
+	}
+	current := strings.TrimPrefix(v.ETag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strong && strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		if strings.TrimPrefix(tag, "W/") == current {
+			return true
+		}
+	}
+	return false
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
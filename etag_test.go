@@ -0,0 +1,205 @@
+package wepi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type item struct {
+	Name string `json:"name"`
+}
+
+// conditional runs a request carrying the given conditional headers.
+func conditional(w *WepiController, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+	return rr
+}
+
+func TestEnableETags_Revalidation(t *testing.T) {
+	w := Get()
+	w.EnableETags()
+	AddGET(w, "/item", func(params ParamsManager, req *http.Request) (item, *CustomResponse, error) {
+		return item{Name: "a"}, nil, nil
+	})
+
+	rr := get(w, "/item")
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("first GET: status = %d, ETag = %q, want 200 and a weak tag", rr.Code, etag)
+	}
+
+	rr = conditional(w, http.MethodGet, "/item", "", map[string]string{"If-None-Match": etag})
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("revalidation: status = %d, want 304", rr.Code)
+	}
+	if rr.Body.Len() != 0 || rr.Header().Get("Content-Type") != "" {
+		t.Errorf("304 carried body %q, Content-Type %q", rr.Body.String(), rr.Header().Get("Content-Type"))
+	}
+	if rr.Header().Get("ETag") != etag {
+		t.Errorf("304 ETag = %q, want %q", rr.Header().Get("ETag"), etag)
+	}
+
+	rr = conditional(w, http.MethodGet, "/item", "", map[string]string{"If-None-Match": `W/"stale"`})
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"name":"a"}` {
+		t.Errorf("stale tag: status = %d, body = %q, want 200 with the body", rr.Code, rr.Body.String())
+	}
+}
+
+func TestETags_OffByDefault(t *testing.T) {
+	w := Get()
+	AddGET(w, "/item", func(params ParamsManager, req *http.Request) (item, *CustomResponse, error) {
+		return item{Name: "a"}, nil, nil
+	})
+	if rr := get(w, "/item"); rr.Header().Get("ETag") != "" {
+		t.Errorf("ETag = %q, want none", rr.Header().Get("ETag"))
+	}
+}
+
+func TestCustomResponse_StrongETag(t *testing.T) {
+	w := Get()
+	w.EnableETags()
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	AddGET(w, "/item", func(params ParamsManager, req *http.Request) (item, *CustomResponse, error) {
+		return item{Name: "a"}, Custom().SetETag("v7").SetLastModified(modified), nil
+	})
+
+	rr := get(w, "/item")
+	if rr.Header().Get("ETag") != `"v7"` {
+		t.Errorf("ETag = %q, want the handler's strong tag", rr.Header().Get("ETag"))
+	}
+	if rr.Header().Get("Last-Modified") != "Wed, 01 May 2024 12:00:00 GMT" {
+		t.Errorf("Last-Modified = %q", rr.Header().Get("Last-Modified"))
+	}
+
+	if rr := conditional(w, http.MethodGet, "/item", "", map[string]string{"If-None-Match": `"v6", W/"v7"`}); rr.Code != http.StatusNotModified {
+		t.Errorf("weak match in list: status = %d, want 304", rr.Code)
+	}
+	since := modified.Add(time.Hour).Format(http.TimeFormat)
+	if rr := conditional(w, http.MethodGet, "/item", "", map[string]string{"If-Modified-Since": since}); rr.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: status = %d, want 304", rr.Code)
+	}
+}
+
+func TestETags_ErrorsAndOtherStatuses(t *testing.T) {
+	w := Get()
+	w.EnableETags()
+	AddGET(w, "/created", func(params ParamsManager, req *http.Request) (item, *CustomResponse, error) {
+		return item{Name: "a"}, Custom().SetStatus(http.StatusCreated), nil
+	})
+
+	rr := get(w, "/created")
+	if rr.Header().Get("ETag") != "" {
+		t.Errorf("201 response got ETag %q", rr.Header().Get("ETag"))
+	}
+}
+
+func TestPreconditions_OptimisticConcurrency(t *testing.T) {
+	w := Get()
+	version := "v1"
+	calls := 0
+	AddJsonPOST(w, "/items/{id}", func(st item, params ParamsManager, req *http.Request) (item, *CustomResponse, error) {
+		calls++
+		version = "v2"
+		return st, Custom().SetETag(version), nil
+	}).Preconditions(func(params ParamsManager, req *http.Request) (ResourceVersion, error) {
+		return ResourceVersion{ETag: version}, nil
+	})
+
+	rr := conditional(w, http.MethodPut, "/items/1", `{"name":"b"}`, map[string]string{"If-Match": `"v0"`})
+	if rr.Code != http.StatusPreconditionFailed || calls != 0 {
+		t.Fatalf("stale If-Match: status = %d, calls = %d, want 412 without calling the handler", rr.Code, calls)
+	}
+
+	rr = conditional(w, http.MethodPut, "/items/1", `{"name":"b"}`, map[string]string{"If-Match": `"v1"`})
+	if rr.Code != http.StatusOK || calls != 1 || rr.Header().Get("ETag") != `"v2"` {
+		t.Fatalf("current If-Match: status = %d, calls = %d, ETag = %q", rr.Code, calls, rr.Header().Get("ETag"))
+	}
+
+	// A weak tag never satisfies If-Match
+	if rr := conditional(w, http.MethodPut, "/items/1", `{"name":"c"}`, map[string]string{"If-Match": `W/"v2"`}); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("weak If-Match: status = %d, want 412", rr.Code)
+	}
+
+	// If-None-Match: * guards creation against an existing resource
+	if rr := conditional(w, http.MethodPost, "/items/1", `{"name":"c"}`, map[string]string{"If-None-Match": "*"}); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("If-None-Match *: status = %d, want 412", rr.Code)
+	}
+}
+
+func TestPreconditions_UnmodifiedSince(t *testing.T) {
+	w := Get()
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	AddJsonPOST(w, "/doc", func(st item, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "saved", nil, nil
+	}).Preconditions(func(params ParamsManager, req *http.Request) (ResourceVersion, error) {
+		return ResourceVersion{LastModified: modified}, nil
+	})
+
+	before := modified.Add(-time.Minute).Format(http.TimeFormat)
+	if rr := conditional(w, http.MethodPost, "/doc", `{}`, map[string]string{"If-Unmodified-Since": before}); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("modified since: status = %d, want 412", rr.Code)
+	}
+	at := modified.Format(http.TimeFormat)
+	if rr := conditional(w, http.MethodPost, "/doc", `{}`, map[string]string{"If-Unmodified-Since": at}); rr.Code != http.StatusOK {
+		t.Errorf("unmodified: status = %d, want 200", rr.Code)
+	}
+}
+
+func TestPreconditions_GETNotModifiedSkipsHandler(t *testing.T) {
+	w := Get()
+	calls := 0
+	AddGET(w, "/item", func(params ParamsManager, req *http.Request) (item, *CustomResponse, error) {
+		calls++
+		return item{Name: "a"}, nil, nil
+	}).Preconditions(func(params ParamsManager, req *http.Request) (ResourceVersion, error) {
+		return ResourceVersion{ETag: "v3"}, nil
+	})
+
+	rr := get(w, "/item")
+	if rr.Header().Get("ETag") != `"v3"` {
+		t.Errorf("ETag = %q, want the route version", rr.Header().Get("ETag"))
+	}
+	rr = conditional(w, http.MethodGet, "/item", "", map[string]string{"If-None-Match": `"v3"`})
+	if rr.Code != http.StatusNotModified || calls != 1 {
+		t.Errorf("status = %d, calls = %d, want 304 and the handler called only for the first GET", rr.Code, calls)
+	}
+	if rr.Header().Get("ETag") != `"v3"` {
+		t.Errorf("304 ETag = %q", rr.Header().Get("ETag"))
+	}
+}
+
+func TestMatchETag(t *testing.T) {
+	strong := ResourceVersion{ETag: `"a"`}
+	weak := ResourceVersion{ETag: `W/"a"`}
+	tests := []struct {
+		header string
+		v      ResourceVersion
+		strong bool
+		want   bool
+	}{
+		{`"a"`, strong, true, true},
+		{`W/"a"`, strong, true, false},
+		{`"a"`, weak, true, false},
+		{`W/"a"`, strong, false, true},
+		{`"b", "a"`, weak, false, true},
+		{`"b"`, strong, false, false},
+		{`*`, strong, true, true},
+		{`*`, ResourceVersion{}, true, false},
+	}
+	for _, tt := range tests {
+		if got := matchETag(tt.header, tt.v, tt.strong); got != tt.want {
+			t.Errorf("matchETag(%q, %q, %v) = %v, want %v", tt.header, tt.v.ETag, tt.strong, got, tt.want)
+		}
+	}
+}
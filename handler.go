@@ -1,19 +1,22 @@
 package wepi
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"reflect"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func (w *WepiController) runUnwrapped(pathHead string, req *http.Request, wr http.ResponseWriter) (bool, error) {
+func (w *WepiController) runUnwrapped(pathHead string, req *http.Request, wr http.ResponseWriter, info *requestInfo) (bool, error) {
 	path := strings.TrimPrefix(req.URL.Path, pathHead)
 
 	// Treat PUT as POST
@@ -32,27 +35,77 @@ func (w *WepiController) runUnwrapped(pathHead string, req *http.Request, wr htt
 	if path == "" {
 		return false, nil // No matching route
 	}
-
 	if req.Method != route.method {
-		log.Println("route " + route.route + " not same method " + req.Method)
 		return false, errors.New("route " + route.route + " not same method " + req.Method)
 	}
 
-	// Extract handler func and its first param type (struct or ParamsManager)
+	return w.serveRoute(route, pathParams, req, wr, info)
+}
+
+// serveRoute serves a matched route. The net/http middlewares of the route and its
+// groups wrap everything from decoding the request to writing the response.
+func (w *WepiController) serveRoute(route *Route, pathParams map[string]string, req *http.Request, wr http.ResponseWriter, info *requestInfo) (bool, error) {
+	info.route = route
+	s := w.cfg()
+	if s.metrics != nil {
+		info.metrics = s.metrics
+		info.metrics.start(info)
+	}
+	if s.tracing != nil {
+		req = s.tracing.startServerSpan(req, info, pathParams)
+	}
+
+	var err error
+	inner := http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		err = w.handleRoute(route, pathParams, req, wr, info)
+	})
+	cwr, closeCompression := w.compressResponse(route, wr, req)
+	completed := false
+	// A flag rather than recover, so the panic reaches instrument with its stack intact
+	defer func() { closeCompression(!completed) }()
+	w.wrapHTTP(route, inner).ServeHTTP(cwr, req)
+	completed = true
+
+	return true, err
+}
+
+// handleRoute decodes and validates the request, runs the interceptors, middlewares
+// and handler of the route, and writes the outcome.
+func (w *WepiController) handleRoute(route *Route, pathParams map[string]string, req *http.Request, wr http.ResponseWriter, info *requestInfo) error {
+	// Extract handler func and its request param type (struct or ParamsManager)
 	handlerFunc, stType, err := validateAndExtractRouteFunc(route)
+	takesContext := handlerFunc.IsValid() && handlerFunc.Type().In(0) == contextType
 	if err != nil {
 		wr.WriteHeader(http.StatusInternalServerError)
-		return true, fmt.Errorf("error on route: "+route.route+", on path "+path+":", err)
+		return fmt.Errorf("error on route: "+route.route+", on path "+req.URL.Path+":", err)
+	}
+
+	// A consumed key without a provider would panic in MustValue: refuse the route instead
+	if len(route.consumes) > 0 {
+		if err := w.cfg().verifyRoute(route); err != nil {
+			w.writeError(wr, req, http.StatusInternalServerError, err.Error())
+			return err
+		}
 	}
 
-	// Parse request body based on Content-Type
-	values, structValue, err := readRequestValues(req, stType)
+	// Bound the body, undo Content-Encoding, then parse it based on Content-Type
+	maxBytes, jsonLimits := w.bodyLimits(route)
+	err = limitBody(wr, req, maxBytes)
+	if err == nil {
+		err = w.decompressRequest(req)
+	}
+	var values map[string]any
+	var structValue reflect.Value
+	if err == nil {
+		values, structValue, err = w.readRequestValues(req, stType, jsonLimits)
+	}
 	if err != nil {
-		wr.WriteHeader(http.StatusBadRequest)
-		if w.ShowErrors() {
-			wr.Write([]byte(err.Error()))
+		status := bodyErrorStatus(err)
+		if status == http.StatusUnsupportedMediaType {
+			wr.Header().Set("Accept-Encoding", "gzip, deflate")
 		}
-		return true, err
+		w.writeError(wr, req, status, err.Error())
+		return err
 	}
 
 	hasStructBody := structValue.IsValid()
@@ -65,6 +118,7 @@ func (w *WepiController) runUnwrapped(pathHead string, req *http.Request, wr htt
 	}
 
 	params := GetParamsManager(values)
+	params.requestID = info.requestID
 
 	// Merge URL path params (e.g. {id}) into the params manager
 	if pathParams != nil {
@@ -76,9 +130,8 @@ func (w *WepiController) runUnwrapped(pathHead string, req *http.Request, wr htt
 	// Build argument list for the handler function
 	if stType == reflect.TypeOf((*ParamsManager)(nil)).Elem() {
 		if hasStructBody {
-			log.Println(errors.New("this request doesnt contain a params manager"))
 			wr.WriteHeader(http.StatusInternalServerError)
-			return true, errors.New("this request doesnt contain a params manager")
+			return errors.New("this request doesnt contain a params manager")
 		}
 
 		stValue = reflect.ValueOf(&params)
@@ -100,20 +153,23 @@ func (w *WepiController) runUnwrapped(pathHead string, req *http.Request, wr htt
 		if validateValue.Kind() == reflect.Struct {
 			err = validatorSingle.Struct(validateValue.Interface())
 			if err != nil {
-				log.Println("Validator Error ", err)
 				wr.WriteHeader(http.StatusUnprocessableEntity)
 				msg := fmt.Sprint("Error parsing data: ", err)
-				json, _ := JsonifyPretty(map[string]any{"error": msg}, "", " ")
+				errBody := map[string]any{"error": msg}
 				if ve, ok := err.(validator.ValidationErrors); ok {
 					list := make([]string, 0)
 					for _, fe := range ve {
 						list = append(list, getValidationError(fe, validateValue.Interface()))
 					}
-					json, _ = JsonifyPretty(map[string]any{"error": "validation errors", "list": list}, "", " ")
+					errBody = map[string]any{"error": "validation errors", "list": list}
 				}
+				if id := RequestIDFromContext(req.Context()); id != "" {
+					errBody["request_id"] = id
+				}
+				json, _ := JsonifyPretty(errBody, "", " ")
 
 				wr.Write([]byte(json))
-				return true, fmt.Errorf("validator Error: %v", msg)
+				return fmt.Errorf("validator Error: %v", msg)
 			}
 		}
 
@@ -125,61 +181,134 @@ func (w *WepiController) runUnwrapped(pathHead string, req *http.Request, wr htt
 	}
 
 	// Set CORS headers
-	if len(w.cors) > 0 {
-		if w.isOriginAllowed(req.Header.Get("Origin")) {
-			wr.Header().Set("Access-Control-Allow-Origin", req.Header.Get("Origin"))
-		}
+	if policy := w.corsPolicyFor(route); policy != nil {
+		policy.setResponseHeaders(wr, req)
 	}
 
-	// Run middlewares; short-circuit if one returns a CustomResponse
-	for _, middleware := range route.Middlewares {
-		if middleware != nil {
-			c, err := middleware(stValue.Elem(), params, req)
-			if err != nil {
-				wr.WriteHeader(http.StatusInternalServerError)
-				return true, err
+	// Context-aware handlers take the request context first
+	if takesContext {
+		args = append([]reflect.Value{reflect.Value{}}, args...)
+	}
+
+	// Innermost layer of the onion: the middleware chain, then the handler
+	core := func(req *http.Request) *Outcome {
+		// Run middlewares; short-circuit if one returns a CustomResponse.
+		// A derived context returned by a middleware flows to the rest of the chain.
+		chain := append(slices.Clip(w.globalMiddlewares(route)), route.middlewareChain()...)
+		for i, middleware := range chain {
+			if err := req.Context().Err(); err != nil {
+				return cancelledOutcome(err)
 			}
 
-			if c != nil {
-				if c.headers != nil {
-					copyHeader(wr.Header(), c.headers)
-				}
-				if c.status != 0 {
-					wr.WriteHeader(c.status)
+			var c *CustomResponse
+			var ctx context.Context
+			err := info.traced(req, "middleware", func(req *http.Request) (err error) {
+				ctx, c, err = middleware(req.Context(), stValue.Elem(), params, req)
+				if ctx == req.Context() {
+					ctx = nil
 				}
-				if len(c.body) > 0 {
-					wr.Write(c.body)
-				}
-				return true, nil
+				return err
+			}, attribute.Int("wepi.middleware.index", i))
+			if err != nil {
+				return &Outcome{Err: err}
+			}
+			if ctx != nil {
+				req = req.WithContext(info.restoreSpan(ctx))
+			}
+			if c != nil {
+				return &Outcome{Custom: c}
 			}
 		}
+
+		if err := req.Context().Err(); err != nil {
+			return cancelledOutcome(err)
+		}
+
+		// Check If-Match & co. against the current version before the handler acts
+		if route.version != nil {
+			if o := checkRouteVersion(route, params, wr, req); o != nil {
+				return o
+			}
+		}
+
+		// Call handler: returns (result, *CustomResponse, error)
+		var results []reflect.Value
+		info.traced(req, "handler", func(req *http.Request) error {
+			if takesContext {
+				args[0] = reflect.ValueOf(req.Context())
+			}
+			args[len(args)-1] = reflect.ValueOf(req)
+			results = handlerFunc.Call(args)
+			if len(results) > 2 && !results[2].IsNil() {
+				return results[2].Interface().(error)
+			}
+			return nil
+		})
+		return outcomeFromResults(results)
 	}
 
-	// Call handler: returns (result, *CustomResponse, error)
-	results := handlerFunc.Call(args)
+	outcome := route.intercept(params, req, core)
+	return w.writeOutcome(wr, req, route, outcome)
+}
 
-	// Check error (third return value)
-	if len(results) > 2 && !results[2].IsNil() {
-		err := results[2].Interface().(error)
-		log.Println("Handler returned error:", err)
-		wr.WriteHeader(http.StatusInternalServerError)
-		wr.Write([]byte(err.Error()))
+// writeError answers with status and, with SetShowErrors, the error message. When
+// the request has an ID, the body is a JSON object carrying it, with the status
+// text as "error" unless errors are shown.
+func (w *WepiController) writeError(wr http.ResponseWriter, req *http.Request, status int, msg string) {
+	id := RequestIDFromContext(req.Context())
+	if id == "" {
+		wr.WriteHeader(status)
 		if w.ShowErrors() {
-			wr.Write([]byte(err.Error()))
+			wr.Write([]byte(msg))
 		}
-		return true, fmt.Errorf("handler returned error: %v", err)
+		return
 	}
 
-	// Extract optional CustomResponse (second return value)
-	var custom *CustomResponse
-	if len(results) > 1 && !results[1].IsNil() {
-		custom = results[1].Interface().(*CustomResponse)
-	} else {
-		custom = nil
+	if !w.ShowErrors() {
+		msg = http.StatusText(status)
+	}
+	body, _ := Jsonify(map[string]any{"error": msg, "request_id": id})
+	wr.Header().Set("Content-Type", "application/json")
+	wr.WriteHeader(status)
+	wr.Write([]byte(body))
+}
+
+// writeOutcome writes the response for what the route produced.
+func (w *WepiController) writeOutcome(wr http.ResponseWriter, req *http.Request, route *Route, outcome *Outcome) error {
+	custom := outcome.Custom
+
+	// Errors answer with the status an interceptor or cancellation chose, 500 otherwise
+	if outcome.Err != nil {
+		status := http.StatusInternalServerError
+		if custom != nil {
+			if custom.headers != nil {
+				copyHeader(wr.Header(), custom.headers)
+			}
+			if custom.status != 0 {
+				status = custom.status
+			}
+		}
+		w.writeError(wr, req, status, outcome.Err.Error())
+		return outcome.Err
+	}
+
+	// Streaming results write the response themselves
+	s, ok := outcome.Value.(streamer)
+	if seq := sequenceOf(outcome.Value); !ok && seq != nil {
+		if custom != nil {
+			seq.status = custom.status
+		}
+		s, ok = seq, true
+	}
+	if ok {
+		if custom != nil && custom.headers != nil {
+			copyHeader(wr.Header(), custom.headers)
+		}
+		return s.stream(w, route, wr, req)
 	}
 
 	// Determine response type: string (text/html), io.Reader, or struct/map (JSON)
-	resultInterface := results[0].Interface()
+	resultInterface := outcome.Value
 	resultValue := reflect.ValueOf(resultInterface)
 
 	if resultValue.Kind() == reflect.Ptr {
@@ -187,12 +316,12 @@ func (w *WepiController) runUnwrapped(pathHead string, req *http.Request, wr htt
 	}
 
 	var js []byte
+	var err error
 
 	if !resultValue.IsValid() {
 		if custom == nil {
-			log.Println("Validator Error: ", errors.New("no data found on route return"))
 			wr.WriteHeader(http.StatusInternalServerError)
-			return true, errors.New("no data found on route return")
+			return errors.New("no data found on route return")
 		}
 	} else if resultValue.Kind() == reflect.String {
 		wr.Header().Add("Content-Type", "text/html")
@@ -202,60 +331,102 @@ func (w *WepiController) runUnwrapped(pathHead string, req *http.Request, wr htt
 	} else {
 		js, err = json.Marshal(resultValue.Interface())
 		if err != nil {
-			log.Println("Error writing data: ", err)
 			wr.Write([]byte(fmt.Sprint("error writing data: ", err)))
 			wr.WriteHeader(http.StatusBadRequest)
-			return true, fmt.Errorf("error writing data: %v", err)
+			return fmt.Errorf("error writing data: %v", err)
 		}
 		wr.Header().Add("Content-Type", "application/json")
 	}
 
 	// Apply CustomResponse overrides if provided
 	body := []byte(js)
-	status := 200
+	status := 0
 
 	if custom != nil {
 		if custom.headers != nil {
-			wr.Header().Del("Content-Type")
+			// A Content-Type set on the CustomResponse replaces the detected one
+			if custom.headers.Get("Content-Type") != "" {
+				wr.Header().Del("Content-Type")
+			}
 			copyHeader(wr.Header(), custom.headers)
 		}
-		if custom.status != 0 {
-			wr.WriteHeader(custom.status)
-			status = custom.status
-		}
+		status = custom.status
 		if len(custom.body) > 0 {
 			body = custom.body
-			_, err = wr.Write(body)
-			return true, err
+			resultInterface = nil
 		}
 	}
 
-	// Stream io.Reader directly to client
+	// Stream io.Reader directly to client, in ranges when it can seek
 	if r, ok := resultInterface.(io.Reader); ok {
-		if rc, ok := resultInterface.(io.Closer); ok {
-			defer rc.Close()
-		}
-
-		if custom.headers == nil {
-			wr.Header().Set("Content-Disposition", `attachment; filename="file"`)
-		}
-
-		io.Copy(wr, r)
-		return true, nil
+		writeReader(wr, req, r, status)
+		return nil
 	}
 
-	log.Printf(req.URL.Path+" response status code: %v", status)
-
-	wr.Write(body)
+	// Answer 304/412 instead when the request's preconditions say so
+	if w.conditionalResponse(wr, req, status, body) {
+		return nil
+	}
 
-	return true, nil
+	if status != 0 {
+		wr.WriteHeader(status)
+	}
+	_, err = wr.Write(body)
+	return err
 }
 
 // Run processes incoming HTTP requests through the wepi routing system.
 // Returns (true, nil) if the route was handled, (false, nil) if no route matched.
 // Returned errors are enriched with the request method and path.
+// Panics in middlewares or handlers are recovered and reported as ErrPanic. A panic
+// after the response was committed is reported too, then Run panics with
+// http.ErrAbortHandler so the server drops the connection instead of ending the
+// response as if it were complete.
 func (w *WepiController) Run(pathHead string, req *http.Request, wr http.ResponseWriter) (bool, error) {
-	handled, err := w.runUnwrapped(pathHead, req, wr)
+	return w.instrument(req, wr, func(req *http.Request, wr http.ResponseWriter, info *requestInfo) (bool, error) {
+		return w.beforeRoutingServe(req, wr, func(req *http.Request, wr http.ResponseWriter) (bool, error) {
+			return w.runUnwrapped(pathHead, req, wr, info)
+		})
+	})
+}
+
+// instrument runs serve with request ID assignment, panic recovery, metrics,
+// tracing and logging around it.
+func (w *WepiController) instrument(req *http.Request, wr http.ResponseWriter, serve func(req *http.Request, wr http.ResponseWriter, info *requestInfo) (bool, error)) (handled bool, err error) {
+	start := time.Now()
+	tw := newTrackingWriter(wr)
+	info := &requestInfo{method: req.Method}
+	req = w.assignRequestID(req, tw, info)
+
+	defer func() {
+		rec := recover()
+		info.endServerSpan(tw, rec, err)
+		aborted := false
+		if rec != nil {
+			// net/http uses this sentinel to abort a response on purpose
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			handled = true
+			aborted = tw.wroteHeader
+			err = fmt.Errorf("%s %s: %w", info.method, req.URL.Path, w.recoverPanic(rec, info, req, tw))
+		}
+		if info.metrics != nil {
+			info.metrics.observe(info, tw, time.Since(start))
+		}
+		if handled {
+			w.logRequest(req, info, tw, time.Since(start), err)
+			if accessLog := w.cfg().accessLog; accessLog != nil {
+				accessLog.log(req, info, tw, start)
+			}
+		}
+		// A response cut short must not look complete: have net/http drop the connection
+		if aborted {
+			panic(http.ErrAbortHandler)
+		}
+	}()
+
+	handled, err = serve(req, tw, info)
 	if err != nil {
 		return handled, fmt.Errorf("%s %s: %w", req.Method, req.URL.Path, err)
 	}
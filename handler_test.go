@@ -1,6 +1,7 @@
 package wepi
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
@@ -113,6 +114,28 @@ func TestRun_HandlerReturnsError(t *testing.T) {
 	}
 }
 
+func TestRun_HandlerErrorBodyNeedsShowErrors(t *testing.T) {
+	for _, showErrors := range []bool{false, true} {
+		w := setupController()
+		if showErrors {
+			w.SetShowErrors()
+		}
+		AddGET[string](w, "/fail", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+			return "", nil, errors.New("database password rejected")
+		})
+
+		rr := httptest.NewRecorder()
+		w.Run("", httptest.NewRequest(http.MethodGet, "/fail", nil), rr)
+		want := ""
+		if showErrors {
+			want = "database password rejected"
+		}
+		if rr.Code != http.StatusInternalServerError || rr.Body.String() != want {
+			t.Errorf("ShowErrors %v: got %d %q, want 500 %q", showErrors, rr.Code, rr.Body.String(), want)
+		}
+	}
+}
+
 func TestRun_CustomResponse(t *testing.T) {
 	w := setupController()
 
@@ -324,3 +347,97 @@ func TestRun_ValidationError(t *testing.T) {
 		t.Errorf("status = %d, want %d", rr.Code, http.StatusUnprocessableEntity)
 	}
 }
+
+type ctxKey string
+
+func TestRun_ContextMiddleware_DerivedContextReachesHandler(t *testing.T) {
+	w := setupController()
+
+	type Input struct {
+		Name string `json:"name"`
+	}
+
+	addUser := func(ctx context.Context, value any, params ParamsManager, req *http.Request) (context.Context, *CustomResponse, error) {
+		return context.WithValue(ctx, ctxKey("user"), "alice"), nil, nil
+	}
+	addTenant := func(ctx context.Context, value any, params ParamsManager, req *http.Request) (context.Context, *CustomResponse, error) {
+		if ctx.Value(ctxKey("user")) != "alice" {
+			t.Error("expected second middleware to see the first one's context")
+		}
+		return context.WithValue(ctx, ctxKey("tenant"), "acme"), nil, nil
+	}
+
+	AddJsonPOSTCtx(w, "/ctx", func(ctx context.Context, st Input, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		if req.Context().Value(ctxKey("tenant")) != "acme" {
+			t.Error("expected req.Context() to carry the derived context")
+		}
+		return ctx.Value(ctxKey("user")).(string) + "@" + ctx.Value(ctxKey("tenant")).(string) + ":" + st.Name, nil, nil
+	}, addUser, addTenant)
+
+	req := httptest.NewRequest(http.MethodPost, "/ctx", strings.NewReader(`{"name":"x"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+
+	handled, err := w.Run("", req, rr)
+	if !handled || err != nil {
+		t.Fatalf("Run returned handled=%v, err=%v", handled, err)
+	}
+	if rr.Body.String() != "alice@acme:x" {
+		t.Errorf("body = %q, want %q", rr.Body.String(), "alice@acme:x")
+	}
+}
+
+func TestRun_ContextMiddleware_CancellationStopsChain(t *testing.T) {
+	w := setupController()
+
+	cancelling := func(ctx context.Context, value any, params ParamsManager, req *http.Request) (context.Context, *CustomResponse, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		return ctx, nil, nil
+	}
+	next := func(ctx context.Context, value any, params ParamsManager, req *http.Request) (context.Context, *CustomResponse, error) {
+		t.Error("middleware after cancellation should not run")
+		return nil, nil, nil
+	}
+
+	AddGETCtx[string](w, "/cancel", func(ctx context.Context, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		t.Error("handler should not run after cancellation")
+		return "", nil, nil
+	}, cancelling, next)
+
+	rr := httptest.NewRecorder()
+	handled, err := w.Run("", httptest.NewRequest(http.MethodGet, "/cancel", nil), rr)
+	if !handled {
+		t.Error("expected handled=true")
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestRun_PlainMiddlewareSeesDerivedContextThroughRequest(t *testing.T) {
+	w := setupController()
+
+	derive := func(ctx context.Context, value any, params ParamsManager, req *http.Request) (context.Context, *CustomResponse, error) {
+		return context.WithValue(ctx, ctxKey("k"), "v"), nil, nil
+	}
+	plain := FromMiddleware(func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		if req.Context().Value(ctxKey("k")) != "v" {
+			return Custom().SetStatus(http.StatusForbidden), nil
+		}
+		return nil, nil
+	})
+
+	AddGETCtx[string](w, "/mixed", func(ctx context.Context, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	}, derive, plain)
+
+	rr := httptest.NewRecorder()
+	w.Run("", httptest.NewRequest(http.MethodGet, "/mixed", nil), rr)
+	if rr.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,158 @@
+package wepi
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// RouteGroup applies settings to every route whose template starts with its prefix,
+// whether the route was registered before or after the group was created.
+type RouteGroup struct {
+	prefix          string
+	httpMiddlewares []func(http.Handler) http.Handler
+	cors            *corsPolicy
+	middlewares     []ContextMiddleware
+	provides        []AnyKey
+
+	controller *WepiController
+	origin     *RouteGroup // on published copies, the group they were copied from
+}
+
+// Group returns a group for the routes under prefix (e.g. "/admin" covers "/admin"
+// and "/admin/users/{id}", not "/administrators").
+func (w *WepiController) Group(prefix string) *RouteGroup {
+	g := &RouteGroup{prefix: strings.TrimSuffix(prefix, "/"), controller: w}
+	w.update(func(s *settings) { s.groups = append(s.groups, g.snapshot()) })
+	return g
+}
+
+// update applies fn to the group and republishes it, like Route.update.
+func (g *RouteGroup) update(fn func(g *RouteGroup)) *RouteGroup {
+	w := g.controller
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	fn(g)
+	w.updateLocked(func(s *settings) {
+		s.groups = slices.Clone(s.groups)
+		for i, published := range s.groups {
+			if published.origin == g {
+				s.groups[i] = g.snapshot()
+			}
+		}
+	})
+	return g
+}
+
+func (g *RouteGroup) snapshot() *RouteGroup {
+	c := *g
+	c.httpMiddlewares = slices.Clip(c.httpMiddlewares)
+	c.middlewares = slices.Clip(c.middlewares)
+	c.provides = slices.Clip(c.provides)
+	c.origin = g
+	return &c
+}
+
+// WrapHTTP wraps standard net/http middleware around every route of the group.
+// Group middlewares run outside route middlewares, in the order they were added.
+func (g *RouteGroup) WrapHTTP(middlewares ...func(http.Handler) http.Handler) *RouteGroup {
+	return g.update(func(g *RouteGroup) { g.httpMiddlewares = append(g.httpMiddlewares, middlewares...) })
+}
+
+// With attaches providers to every route of the group except Public ones. They run
+// after the middlewares registered with Use and before the route's own middlewares.
+func (g *RouteGroup) With(providers ...*Provider) *RouteGroup {
+	return g.update(func(g *RouteGroup) {
+		for _, p := range providers {
+			g.middlewares = append(g.middlewares, p.middleware)
+			g.provides = append(g.provides, p.keys...)
+		}
+	})
+}
+
+func (g *RouteGroup) contains(template string) bool {
+	return g.prefix == "" || template == g.prefix || strings.HasPrefix(template, g.prefix+"/")
+}
+
+// WrapHTTP wraps standard net/http middleware around the route. It runs after route
+// matching and before the request is decoded, so context and header changes it makes
+// on the request are visible to wepi middlewares and the handler. The first one added
+// is the outermost.
+func (r *Route) WrapHTTP(middlewares ...func(http.Handler) http.Handler) *Route {
+	return r.update(func(r *Route) { r.httpMiddlewares = append(r.httpMiddlewares, middlewares...) })
+}
+
+// wrapHTTP wraps inner in the net/http middlewares of the route's groups and the route.
+func (w *WepiController) wrapHTTP(route *Route, inner http.Handler) http.Handler {
+	var chain []func(http.Handler) http.Handler
+	for _, g := range w.cfg().groups {
+		if g.contains(route.route) {
+			chain = append(chain, g.httpMiddlewares...)
+		}
+	}
+	chain = append(chain, route.httpMiddlewares...)
+
+	h := inner
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i](h)
+	}
+	return h
+}
+
+// ServeHTTP serves the route as a standard http.Handler, e.g. mounted on an
+// http.ServeMux. Path parameters are read from req.URL.Path using the route template,
+// or, when the path doesn't match it (a prefix, http.StripPrefix), from the
+// ServeMux wildcards of the same names; without them the request gets 404.
+// Other methods than the route's get 405, with PUT treated as POST like in Run.
+// Routes built on a RouteSet can only be served once published.
+func (r *Route) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	w := r.controller
+	if w == nil {
+		http.Error(wr, "route "+r.route+" is not published on a controller", http.StatusInternalServerError)
+		return
+	}
+	route := r.published()
+	w.instrument(req, wr, func(req *http.Request, wr http.ResponseWriter, info *requestInfo) (bool, error) {
+		// Treat PUT as POST
+		if req.Method == http.MethodPut {
+			req.Method = http.MethodPost
+		}
+		if req.Method != route.method {
+			allow := route.method
+			if allow == http.MethodPost {
+				allow += ", " + http.MethodPut
+			}
+			wr.Header().Set("Allow", allow)
+			http.Error(wr, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return true, nil
+		}
+		var pathParams map[string]string
+		if route.pattern != nil {
+			pathParams = extractPatternValues(route.pattern.regex, route.pattern.keys, req.URL.Path)
+			if pathParams == nil {
+				// Mounted under a prefix: use the wildcards the mux matched
+				pathParams = make(map[string]string, len(route.pattern.keys))
+				for _, key := range route.pattern.keys {
+					v := req.PathValue(key)
+					if v == "" {
+						http.NotFound(wr, req)
+						return true, nil
+					}
+					pathParams[key] = v
+				}
+			}
+		}
+		return w.serveRoute(route, pathParams, req, wr, info)
+	})
+}
+
+// Handler exposes the controller as a standard http.Handler that runs every request
+// through Run and answers 404 when no route matches.
+func (w *WepiController) Handler(pathHead string) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		handled, _ := w.Run(pathHead, req, wr)
+		if !handled {
+			http.NotFound(wr, req)
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package wepi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type httpUserKey struct{}
+
+// setUser is a standard net/http middleware storing a header value in the context
+func setUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), httpUserKey{}, req.Header.Get("X-User"))
+		req = req.WithContext(ctx)
+		req.Header.Set("X-Authenticated", "yes")
+		next.ServeHTTP(wr, req)
+	})
+}
+
+func requireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-User") == "" {
+			http.Error(wr, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(wr, req)
+	})
+}
+
+func tagHeader(value string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+			wr.Header().Add("X-Order", value)
+			next.ServeHTTP(wr, req)
+		})
+	}
+}
+
+func whoAmI(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+	user, _ := req.Context().Value(httpUserKey{}).(string)
+	return user + ":" + req.Header.Get("X-Authenticated"), nil, nil
+}
+
+func TestRouteWrapHTTP_ContextAndHeadersReachHandler(t *testing.T) {
+	w := Get()
+	AddGET(w, "/me", whoAmI).WrapHTTP(setUser)
+
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Set("X-User", "ann")
+	rr := httptest.NewRecorder()
+	handled, err := w.Run("", req, rr)
+
+	if !handled || err != nil {
+		t.Fatalf("Run = %v, %v", handled, err)
+	}
+	if rr.Body.String() != "ann:yes" {
+		t.Errorf("body = %q, want ann:yes", rr.Body.String())
+	}
+}
+
+func TestRouteWrapHTTP_ContextReachesCtxMiddleware(t *testing.T) {
+	w := Get()
+	var seen string
+	mw := func(ctx context.Context, value any, params ParamsManager, req *http.Request) (context.Context, *CustomResponse, error) {
+		seen, _ = ctx.Value(httpUserKey{}).(string)
+		return nil, nil, nil
+	}
+	AddGETCtx(w, "/me", func(ctx context.Context, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	}, mw).WrapHTTP(setUser)
+
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Set("X-User", "bob")
+	w.Run("", req, httptest.NewRecorder())
+
+	if seen != "bob" {
+		t.Errorf("middleware saw user %q, want bob", seen)
+	}
+}
+
+func TestRouteWrapHTTP_ShortCircuit(t *testing.T) {
+	w := Get()
+	called := false
+	AddGET(w, "/me", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		called = true
+		return "ok", nil, nil
+	}).WrapHTTP(requireUser)
+
+	rr := httptest.NewRecorder()
+	handled, err := w.Run("", httptest.NewRequest(http.MethodGet, "/me", nil), rr)
+
+	if !handled || err != nil {
+		t.Fatalf("Run = %v, %v", handled, err)
+	}
+	if called {
+		t.Error("handler ran although the middleware short-circuited")
+	}
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestGroupWrapHTTP_Order(t *testing.T) {
+	w := Get()
+	w.Group("/admin").WrapHTTP(tagHeader("group1"), tagHeader("group2"))
+	AddGET(w, "/admin/users/{id}", whoAmI).WrapHTTP(tagHeader("route"))
+	AddGET(w, "/administrators", whoAmI)
+
+	rr := httptest.NewRecorder()
+	w.Run("", httptest.NewRequest(http.MethodGet, "/admin/users/3", nil), rr)
+	got := strings.Join(rr.Header().Values("X-Order"), ",")
+	if got != "group1,group2,route" {
+		t.Errorf("X-Order = %q, want group1,group2,route", got)
+	}
+
+	rr = httptest.NewRecorder()
+	w.Run("", httptest.NewRequest(http.MethodGet, "/administrators", nil), rr)
+	if got := rr.Header().Values("X-Order"); len(got) != 0 {
+		t.Errorf("group applied outside its prefix: %v", got)
+	}
+}
+
+func TestRouteServeHTTP(t *testing.T) {
+	w := Get()
+	route := AddGET(w, "/device/{id}", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "device " + params.GetString("id", ""), nil, nil
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /device/{id}", setUser(route))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/device/42", nil))
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "device 42" {
+		t.Errorf("got %d %q, want 200 \"device 42\"", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHandler_NotFound(t *testing.T) {
+	w := Get()
+	AddGET(w, "/ping", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "pong", nil, nil
+	})
+	h := w.Handler("/api")
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/ping", nil))
+	if rr.Body.String() != "pong" {
+		t.Errorf("body = %q, want pong", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/missing", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", rr.Code)
+	}
+}
+
+func TestRouteServeHTTP_MethodNotAllowed(t *testing.T) {
+	w := Get()
+	route := AddJsonPOST(w, "/items", func(st tenantInput, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "created", nil, nil
+	})
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		rr := httptest.NewRecorder()
+		route.ServeHTTP(rr, httptest.NewRequest(method, "/items", nil))
+		if rr.Code != http.StatusMethodNotAllowed || rr.Header().Get("Allow") != "POST, PUT" {
+			t.Errorf("%s: status = %d, Allow = %q, want 405 \"POST, PUT\"", method, rr.Code, rr.Header().Get("Allow"))
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	route.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/items", strings.NewReader(`{}`)))
+	if rr.Code != http.StatusOK || rr.Body.String() != "created" {
+		t.Errorf("PUT: got %d %q, want it served like POST", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRouteServeHTTP_Unpublished(t *testing.T) {
+	route := AddGET(NewRouteSet(), "/draft", okHandler)
+
+	rr := httptest.NewRecorder()
+	route.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/draft", nil))
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rr.Code)
+	}
+}
+
+func TestRouteServeHTTP_Mounted(t *testing.T) {
+	w := Get()
+	route := AddGET(w, "/device/{id}", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "device " + params.GetString("id", ""), nil, nil
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/v1/device/{id}", route)
+	mux.Handle("GET /stripped/", http.StripPrefix("/stripped", route))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/device/42", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "device 42" {
+		t.Errorf("under a prefix: got %d %q, want the mux wildcard", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stripped/device/7", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "device 7" {
+		t.Errorf("behind StripPrefix: got %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stripped/other/7", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("path not matching the template: status = %d, want 404", rr.Code)
+	}
+}
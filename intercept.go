@@ -0,0 +1,65 @@
+package wepi
+
+import (
+	"net/http"
+	"reflect"
+)
+
+// Outcome is what a route produced before it is written: the handler's result value,
+// CustomResponse and error, or the CustomResponse or error a middleware short-circuited with.
+type Outcome struct {
+	Value  any
+	Custom *CustomResponse
+	Err    error
+}
+
+// Response returns the outcome's CustomResponse, creating an empty one if needed,
+// so interceptors can set the status or headers of any outcome.
+func (o *Outcome) Response() *CustomResponse {
+	if o.Custom == nil {
+		o.Custom = Custom()
+	}
+	return o.Custom
+}
+
+// Interceptor wraps a route's middleware chain and handler (onion model). It calls next
+// to run the inner layers and may inspect, modify or replace the returned outcome
+// before it is written, or return an outcome of its own without calling next.
+type Interceptor func(params ParamsManager, req *http.Request, next func(req *http.Request) *Outcome) *Outcome
+
+// Around adds interceptors to the route. The first one added is the outermost.
+func (r *Route) Around(interceptors ...Interceptor) *Route {
+	return r.update(func(r *Route) { r.interceptors = append(r.interceptors, interceptors...) })
+}
+
+// intercept runs core wrapped in the route's interceptors.
+func (r *Route) intercept(params ParamsManager, req *http.Request, core func(req *http.Request) *Outcome) *Outcome {
+	next := core
+	for i := len(r.interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := r.interceptors[i], next
+		next = func(req *http.Request) *Outcome {
+			if o := interceptor(params, req, inner); o != nil {
+				return o
+			}
+			return &Outcome{}
+		}
+	}
+	return next(req)
+}
+
+// outcomeFromResults converts the (R, *CustomResponse, error) returned by a handler.
+func outcomeFromResults(results []reflect.Value) *Outcome {
+	outcome := &Outcome{Value: results[0].Interface()}
+	if len(results) > 1 && !results[1].IsNil() {
+		outcome.Custom = results[1].Interface().(*CustomResponse)
+	}
+	if len(results) > 2 && !results[2].IsNil() {
+		outcome.Err = results[2].Interface().(error)
+	}
+	return outcome
+}
+
+// cancelledOutcome answers a request whose context ended before the handler ran.
+func cancelledOutcome(err error) *Outcome {
+	return &Outcome{Custom: Custom().SetStatus(http.StatusServiceUnavailable), Err: err}
+}
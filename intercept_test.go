@@ -0,0 +1,167 @@
+package wepi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var errNotFound = errors.New("not found")
+
+func TestAround_EnvelopeAndHeaders(t *testing.T) {
+	w := Get()
+
+	envelope := func(params ParamsManager, req *http.Request, next func(req *http.Request) *Outcome) *Outcome {
+		o := next(req)
+		if o.Err == nil {
+			o.Value = map[string]any{"data": o.Value}
+			o.Response().SetHeader("Cache-Control", "max-age=60")
+		}
+		return o
+	}
+
+	AddGET(w, "/items/{id}", func(params ParamsManager, req *http.Request) (map[string]string, *CustomResponse, error) {
+		return map[string]string{"id": params.GetString("id", "")}, nil, nil
+	}).Around(envelope)
+
+	rr := httptest.NewRecorder()
+	w.Run("", httptest.NewRequest(http.MethodGet, "/items/3", nil), rr)
+
+	var body map[string]map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to unmarshal %q: %v", rr.Body.String(), err)
+	}
+	if body["data"]["id"] != "3" {
+		t.Errorf("body = %v, want enveloped id 3", body)
+	}
+	if got := rr.Header().Get("Cache-Control"); got != "max-age=60" {
+		t.Errorf("Cache-Control = %q, want max-age=60", got)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json to survive added headers", got)
+	}
+}
+
+func TestAround_MapsErrorToStatus(t *testing.T) {
+	w := Get()
+
+	mapErrors := func(params ParamsManager, req *http.Request, next func(req *http.Request) *Outcome) *Outcome {
+		o := next(req)
+		if errors.Is(o.Err, errNotFound) {
+			return &Outcome{Value: map[string]string{"error": "no such item"}, Custom: Custom().SetStatus(http.StatusNotFound)}
+		}
+		return o
+	}
+
+	AddGET[string](w, "/items/{id}", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "", nil, errNotFound
+	}).Around(mapErrors)
+
+	rr := httptest.NewRecorder()
+	handled, err := w.Run("", httptest.NewRequest(http.MethodGet, "/items/9", nil), rr)
+	if !handled || err != nil {
+		t.Fatalf("Run returned handled=%v, err=%v", handled, err)
+	}
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestAround_ErrorStatusFromInterceptor(t *testing.T) {
+	w := Get()
+
+	conflict := func(params ParamsManager, req *http.Request, next func(req *http.Request) *Outcome) *Outcome {
+		o := next(req)
+		if o.Err != nil {
+			o.Response().SetStatus(http.StatusConflict)
+		}
+		return o
+	}
+
+	AddGET[string](w, "/x", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "", nil, errors.New("version mismatch")
+	}).Around(conflict)
+
+	rr := httptest.NewRecorder()
+	_, err := w.Run("", httptest.NewRequest(http.MethodGet, "/x", nil), rr)
+	if err == nil {
+		t.Error("expected the handler error to be returned")
+	}
+	if rr.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusConflict)
+	}
+}
+
+func TestAround_SeesMiddlewareShortCircuit(t *testing.T) {
+	w := Get()
+
+	var audited int
+	audit := func(params ParamsManager, req *http.Request, next func(req *http.Request) *Outcome) *Outcome {
+		o := next(req)
+		audited = o.Response().Status()
+		return o
+	}
+	deny := func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		return Custom().SetStatus(http.StatusForbidden), nil
+	}
+
+	AddGET[string](w, "/secret", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "secret", nil, nil
+	}, deny).Around(audit)
+
+	rr := httptest.NewRecorder()
+	w.Run("", httptest.NewRequest(http.MethodGet, "/secret", nil), rr)
+
+	if audited != http.StatusForbidden {
+		t.Errorf("audited status = %d, want %d", audited, http.StatusForbidden)
+	}
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestAround_OrderAndShortCircuit(t *testing.T) {
+	w := Get()
+
+	var order []string
+	layer := func(name string) Interceptor {
+		return func(params ParamsManager, req *http.Request, next func(req *http.Request) *Outcome) *Outcome {
+			order = append(order, name+" in")
+			o := next(req)
+			order = append(order, name+" out")
+			return o
+		}
+	}
+	cached := func(params ParamsManager, req *http.Request, next func(req *http.Request) *Outcome) *Outcome {
+		return &Outcome{Value: "cached"}
+	}
+
+	AddGET[string](w, "/ordered", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		order = append(order, "handler")
+		return "fresh", nil, nil
+	}).Around(layer("outer"), layer("inner"))
+
+	AddGET[string](w, "/cached", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		t.Error("handler should not run when an interceptor answers")
+		return "fresh", nil, nil
+	}).Around(cached)
+
+	w.Run("", httptest.NewRequest(http.MethodGet, "/ordered", nil), httptest.NewRecorder())
+	want := []string{"outer in", "inner in", "handler", "inner out", "outer out"}
+	if len(order) != len(want) {
+		t.Fatalf("order = %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("order = %v, want %v", order, want)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	w.Run("", httptest.NewRequest(http.MethodGet, "/cached", nil), rr)
+	if rr.Body.String() != "cached" {
+		t.Errorf("body = %q, want cached", rr.Body.String())
+	}
+}
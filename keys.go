@@ -0,0 +1,142 @@
+package wepi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Key identifies a typed request-scoped value stored in ParamsManager by middlewares.
+// Keys are compared by identity, so declare each one once as a package variable:
+//
+//	var UserKey = wepi.NewKey[User]("user")
+type Key[T any] struct {
+	name string
+}
+
+// NewKey creates a key for values of type T. The name is only used in error messages.
+func NewKey[T any](name string) *Key[T] {
+	return &Key[T]{name: name}
+}
+
+func (k *Key[T]) String() string {
+	return k.name
+}
+
+func (k *Key[T]) keyName() string {
+	return k.name
+}
+
+// AnyKey is implemented by every *Key[T], so keys of different types can be listed together.
+type AnyKey interface {
+	keyName() string
+}
+
+// SetValue stores v under key for the rest of the request.
+func SetValue[T any](params ParamsManager, key *Key[T], v T) {
+	params.values[key] = v
+}
+
+// Value returns the value stored under key and whether one was set.
+func Value[T any](params ParamsManager, key *Key[T]) (T, bool) {
+	v, ok := params.values[key].(T)
+	return v, ok
+}
+
+// MustValue returns the value stored under key and panics if none was set,
+// which means the route is missing the middleware that provides it.
+func MustValue[T any](params ParamsManager, key *Key[T]) T {
+	v, ok := Value(params, key)
+	if !ok {
+		panic(fmt.Sprintf("wepi: no value for key %q; is its provider middleware attached to the route?", key.name))
+	}
+	return v
+}
+
+// Provider is a middleware declared to set one or more keys. Attach it with
+// Route.With, RouteGroup.With or UseProviders so Verify can check that routes
+// consuming a key get it.
+type Provider struct {
+	middleware ContextMiddleware
+	keys       []AnyKey
+}
+
+// NewProvider declares that middleware sets the given keys.
+func NewProvider(middleware func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error), keys ...AnyKey) *Provider {
+	return &Provider{middleware: FromMiddleware(middleware), keys: keys}
+}
+
+// ProvideValue builds a provider that stores the value returned by load under key.
+// Returning a CustomResponse or an error short-circuits like any middleware.
+func ProvideValue[T any](key *Key[T], load func(params ParamsManager, req *http.Request) (T, *CustomResponse, error)) *Provider {
+	return NewProvider(func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		v, c, err := load(params, req)
+		if err != nil || c != nil {
+			return c, err
+		}
+		SetValue(params, key, v)
+		return nil, nil
+	}, key)
+}
+
+// With attaches providers to the route; they run after the middlewares passed to the composer.
+func (r *Route) With(providers ...*Provider) *Route {
+	return r.update(func(r *Route) {
+		for _, p := range providers {
+			r.ctxMiddlewares = append(r.ctxMiddlewares, p.middleware)
+			r.provides = append(r.provides, p.keys...)
+		}
+	})
+}
+
+// Consumes declares keys the route's handler reads, for Verify to check.
+func (r *Route) Consumes(keys ...AnyKey) *Route {
+	return r.update(func(r *Route) { r.consumes = append(r.consumes, keys...) })
+}
+
+// Verify checks every route's declared consumed keys against the providers that run
+// on it: its own, its groups' and the controller's. Call it once after registering
+// routes, before serving, to fail startup on a missing provider. The same check
+// runs wherever a route can't be caught before that: Swap and ReplaceRoute refuse
+// routes that fail it, and Run answers 500 with the error before the route's
+// middlewares and handler run, so a forgotten provider never reaches MustValue.
+// Registration itself doesn't check, since providers are attached by the calls
+// chained after it.
+func (w *WepiController) Verify() error {
+	s := w.cfg()
+	var errs []error
+	for _, route := range w.table.Load().routes {
+		errs = append(errs, s.verifyRoute(route))
+	}
+	return errors.Join(errs...)
+}
+
+// verifyRoute reports the keys route consumes that no provider running on it sets.
+func (s *settings) verifyRoute(route *Route) error {
+	var errs []error
+	for _, key := range route.consumes {
+		if !s.providesKey(route, key) {
+			errs = append(errs, fmt.Errorf("route %s %s consumes key %q but no attached provider sets it", route.method, route.route, key.keyName()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *settings) providesKey(route *Route, key AnyKey) bool {
+	if slices.Contains(route.provides, key) {
+		return true
+	}
+	if route.public {
+		return false
+	}
+	if slices.Contains(s.provides, key) {
+		return true
+	}
+	for _, g := range s.groups {
+		if g.contains(route.route) && slices.Contains(g.provides, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package wepi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testUser struct {
+	ID   string
+	Name string
+}
+
+func TestValue_RoundTrip(t *testing.T) {
+	key := NewKey[testUser]("user")
+	params := GetParamsManager(map[string]any{})
+
+	if _, ok := Value(params, key); ok {
+		t.Error("expected no value before SetValue")
+	}
+
+	SetValue(params, key, testUser{ID: "1"})
+
+	u, ok := Value(params, key)
+	if !ok || u.ID != "1" {
+		t.Errorf("Value = %+v, %v; want ID 1, true", u, ok)
+	}
+}
+
+func TestValue_KeysWithSameNameAreDistinct(t *testing.T) {
+	a := NewKey[string]("id")
+	b := NewKey[string]("id")
+	params := GetParamsManager(map[string]any{})
+
+	SetValue(params, a, "from a")
+
+	if _, ok := Value(params, b); ok {
+		t.Error("expected keys to be compared by identity, not name")
+	}
+}
+
+func TestMustValue_PanicsWithKeyName(t *testing.T) {
+	key := NewKey[int]("quota")
+	defer func() {
+		rec := recover()
+		if rec == nil || !strings.Contains(rec.(string), `"quota"`) {
+			t.Errorf("recovered %v, want panic naming the key", rec)
+		}
+	}()
+	MustValue(GetParamsManager(map[string]any{}), key)
+}
+
+func TestProvideValue_ReachesHandler(t *testing.T) {
+	w := Get()
+	userKey := NewKey[testUser]("user")
+
+	auth := ProvideValue(userKey, func(params ParamsManager, req *http.Request) (testUser, *CustomResponse, error) {
+		if req.Header.Get("Authorization") == "" {
+			return testUser{}, Custom().SetStatus(http.StatusUnauthorized), nil
+		}
+		return testUser{ID: "7", Name: "alice"}, nil, nil
+	})
+
+	AddGET[string](w, "/me", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return MustValue(params, userKey).Name, nil, nil
+	}).With(auth).Consumes(userKey)
+
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Set("Authorization", "token")
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+	if rr.Body.String() != "alice" {
+		t.Errorf("body = %q, want alice", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	w.Run("", httptest.NewRequest(http.MethodGet, "/me", nil), rr)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	w := Get()
+	userKey := NewKey[testUser]("user")
+	tenantKey := NewKey[string]("tenant")
+
+	auth := NewProvider(func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		SetValue(params, userKey, testUser{ID: "1"})
+		return nil, nil
+	}, userKey)
+
+	handler := func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	}
+
+	AddGET(w, "/ok", handler).With(auth).Consumes(userKey)
+	if err := w.Verify(); err != nil {
+		t.Fatalf("Verify() = %v, want nil", err)
+	}
+
+	AddGET(w, "/missing-provider", handler).Consumes(userKey)
+	AddGET(w, "/wrong-provider", handler).With(auth).Consumes(tenantKey)
+
+	err := w.Verify()
+	if err == nil {
+		t.Fatal("expected Verify to report missing providers")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, "/missing-provider") || !strings.Contains(msg, `"user"`) {
+		t.Errorf("error %q should name the route and key", msg)
+	}
+	if !strings.Contains(msg, "/wrong-provider") || !strings.Contains(msg, `"tenant"`) {
+		t.Errorf("error %q should name the route and key", msg)
+	}
+	if strings.Contains(msg, "/ok") {
+		t.Errorf("error %q should not mention the satisfied route", msg)
+	}
+}
+
+func TestVerify_UseAndGroupProviders(t *testing.T) {
+	w := Get()
+	userKey := NewKey[testUser]("user")
+	tenantKey := NewKey[string]("tenant")
+
+	w.UseProviders(ProvideValue(userKey, func(params ParamsManager, req *http.Request) (testUser, *CustomResponse, error) {
+		return testUser{Name: "alice"}, nil, nil
+	}))
+	w.Group("/tenants").With(ProvideValue(tenantKey, func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "acme", nil, nil
+	}))
+
+	AddGET(w, "/tenants/me", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return MustValue(params, userKey).Name + "@" + MustValue(params, tenantKey), nil, nil
+	}).Consumes(userKey, tenantKey)
+	if err := w.Verify(); err != nil {
+		t.Fatalf("Verify() = %v, want nil", err)
+	}
+	if rr := get(w, "/tenants/me"); rr.Body.String() != "alice@acme" {
+		t.Errorf("body = %q, want the values set by the Use and group providers", rr.Body.String())
+	}
+
+	AddGET(w, "/me", okHandler).Consumes(tenantKey)          // outside the group
+	AddGET(w, "/open", okHandler).Public().Consumes(userKey) // Public skips Use providers
+	err := w.Verify()
+	if err == nil {
+		t.Fatal("expected Verify to report missing providers")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "/me") || !strings.Contains(msg, "/open") || strings.Contains(msg, "/tenants/me") {
+		t.Errorf("error %q should name /me and /open only", msg)
+	}
+}
+
+func TestSwapAndReplaceRoute_RefuseMissingProviders(t *testing.T) {
+	w := Get()
+	userKey := NewKey[testUser]("user")
+	AddGET(w, "/me", textHandler("v1"))
+
+	set := NewRouteSet()
+	route := AddGET(set, "/me", textHandler("v2")).Consumes(userKey)
+	if err := w.Swap(set); err == nil || !strings.Contains(err.Error(), `"user"`) {
+		t.Errorf("Swap error = %v, want it to name the missing key", err)
+	}
+	if err := w.ReplaceRoute(route); err == nil {
+		t.Error("ReplaceRoute accepted a route missing its provider")
+	}
+	if rr := get(w, "/me"); rr.Body.String() != "v1" {
+		t.Errorf("body = %q, want the old route kept", rr.Body.String())
+	}
+
+	w.UseProviders(NewProvider(func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		SetValue(params, userKey, testUser{})
+		return nil, nil
+	}, userKey))
+	if err := w.Swap(set); err != nil {
+		t.Errorf("Swap() = %v once a Use provider sets the key", err)
+	}
+}
+
+func TestRun_RefusesRouteMissingProvider(t *testing.T) {
+	w := Get()
+	userKey := NewKey[testUser]("user")
+	ran := false
+	AddGET(w, "/me", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		ran = true
+		return MustValue(params, userKey).Name, nil, nil
+	}).Consumes(userKey)
+
+	rr := httptest.NewRecorder()
+	_, err := w.Run("", httptest.NewRequest(http.MethodGet, "/me", nil), rr)
+	if rr.Code != http.StatusInternalServerError || err == nil || !strings.Contains(err.Error(), `"user"`) {
+		t.Errorf("status = %d, err = %v, want 500 naming the key", rr.Code, err)
+	}
+	if errors.Is(err, ErrPanic) || ran {
+		t.Error("the handler ran without its provider")
+	}
+
+	w.UseProviders(ProvideValue(userKey, func(params ParamsManager, req *http.Request) (testUser, *CustomResponse, error) {
+		return testUser{Name: "alice"}, nil, nil
+	}))
+	if rr := get(w, "/me"); rr.Body.String() != "alice" {
+		t.Errorf("body = %q once the provider is attached", rr.Body.String())
+	}
+}
@@ -0,0 +1,137 @@
+package wepi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrJSONLimit is returned when a JSON body exceeds the nesting depth or array
+// length allowed by JSONLimits; the request is answered with 400.
+var ErrJSONLimit = errors.New("wepi: JSON body exceeds limits")
+
+// JSONLimits configures how JSON request bodies are decoded.
+type JSONLimits struct {
+	MaxDepth              int  // deepest nesting of objects and arrays; unlimited if 0
+	MaxArrayLength        int  // most elements in any one array; unlimited if 0
+	DisallowUnknownFields bool // reject fields the route struct doesn't have
+	UseNumber             bool // decode numbers into any-typed fields as json.Number
+}
+
+// SetMaxBodyBytes bounds the size of request bodies as received, before any
+// decompression. Larger bodies are answered with 413. 0 means no limit.
+func (w *WepiController) SetMaxBodyBytes(n int64) {
+	w.update(func(s *settings) { s.maxBodyBytes = n })
+}
+
+// SetJSONLimits sets how JSON bodies are decoded on routes without their own limits.
+func (w *WepiController) SetJSONLimits(limits JSONLimits) {
+	w.update(func(s *settings) { s.jsonLimits = limits })
+}
+
+// MaxBodyBytes overrides the controller body size limit for the route.
+func (r *Route) MaxBodyBytes(n int64) *Route {
+	return r.update(func(r *Route) { r.maxBodyBytes = &n })
+}
+
+// JSONLimits overrides the controller JSON limits for the route.
+func (r *Route) JSONLimits(limits JSONLimits) *Route {
+	return r.update(func(r *Route) { r.jsonLimits = &limits })
+}
+
+// bodyLimits resolves the body size limit and JSON limits of route.
+func (w *WepiController) bodyLimits(route *Route) (int64, JSONLimits) {
+	s := w.cfg()
+	maxBytes, limits := s.maxBodyBytes, s.jsonLimits
+	if route.maxBodyBytes != nil {
+		maxBytes = *route.maxBodyBytes
+	}
+	if route.jsonLimits != nil {
+		limits = *route.jsonLimits
+	}
+	return maxBytes, limits
+}
+
+// decodeJSON decodes one JSON value from r into v under limits.
+func decodeJSON(r io.Reader, v any, limits JSONLimits) error {
+	if limits.MaxDepth > 0 || limits.MaxArrayLength > 0 {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if err := checkJSONLimits(data, limits); err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	dec := json.NewDecoder(r)
+	if limits.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if limits.UseNumber {
+		dec.UseNumber()
+	}
+	return dec.Decode(v)
+}
+
+// checkJSONLimits walks the tokens of the first JSON value in data, tracking the
+// nesting depth and the element count of open arrays.
+func checkJSONLimits(data []byte, limits JSONLimits) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber() // numbers only need to be skipped
+	var open []int  // per open container: element count for arrays, -1 for objects
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		delim, isDelim := tok.(json.Delim)
+		if isDelim && (delim == ']' || delim == '}') {
+			open = open[:len(open)-1]
+			if len(open) == 0 {
+				return nil
+			}
+			continue
+		}
+
+		if n := len(open); n > 0 && open[n-1] >= 0 {
+			open[n-1]++
+			if limits.MaxArrayLength > 0 && open[n-1] > limits.MaxArrayLength {
+				return fmt.Errorf("%w: array longer than %d elements", ErrJSONLimit, limits.MaxArrayLength)
+			}
+		}
+
+		if isDelim {
+			if delim == '[' {
+				open = append(open, 0)
+			} else {
+				open = append(open, -1)
+			}
+			if limits.MaxDepth > 0 && len(open) > limits.MaxDepth {
+				return fmt.Errorf("%w: nested deeper than %d", ErrJSONLimit, limits.MaxDepth)
+			}
+		} else if len(open) == 0 {
+			return nil // a scalar top-level value
+		}
+	}
+}
+
+// limitBody wraps the request body in http.MaxBytesReader when the route has a limit.
+func limitBody(wr http.ResponseWriter, req *http.Request, maxBytes int64) error {
+	if maxBytes <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if req.ContentLength > maxBytes {
+		return &http.MaxBytesError{Limit: maxBytes}
+	}
+	req.Body = http.MaxBytesReader(wr, req.Body, maxBytes)
+	return nil
+}
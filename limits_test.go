@@ -0,0 +1,143 @@
+package wepi
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaxBodyBytes_Controller(t *testing.T) {
+	w := Get()
+	w.SetMaxBodyBytes(32)
+	AddJsonPOST(w, "/items", echoTenant)
+
+	if rr := postJSON(w, "/items", `{"tenant_id":"a","name":"b"}`); rr.Code != http.StatusOK {
+		t.Errorf("small body: status = %d, want 200", rr.Code)
+	}
+	if rr := postJSON(w, "/items", `{"tenant_id":"`+strings.Repeat("a", 100)+`"}`); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large body: status = %d, want %d", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestMaxBodyBytes_UnknownLength(t *testing.T) {
+	w := Get()
+	w.SetMaxBodyBytes(32)
+	AddJsonPOST(w, "/items", echoTenant)
+
+	req := httptest.NewRequest(http.MethodPost, "/items", strings.NewReader(`{"tenant_id":"`+strings.Repeat("a", 100)+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.ContentLength = -1 // chunked
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestMaxBodyBytes_RouteOverride(t *testing.T) {
+	w := Get()
+	w.SetMaxBodyBytes(16)
+	AddJsonPOST(w, "/upload", echoTenant).MaxBodyBytes(1 << 20)
+	AddFormPost(w, "/form", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	}).MaxBodyBytes(8)
+
+	if rr := postJSON(w, "/upload", `{"tenant_id":"`+strings.Repeat("a", 100)+`"}`); rr.Code != http.StatusOK {
+		t.Errorf("route with larger limit: status = %d, want 200", rr.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/form", strings.NewReader("name="+strings.Repeat("x", 50)))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("form over route limit: status = %d, want %d", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestCheckJSONLimits(t *testing.T) {
+	tests := []struct {
+		body   string
+		limits JSONLimits
+		ok     bool
+	}{
+		{`{"a":{"b":{"c":1}}}`, JSONLimits{MaxDepth: 3}, true},
+		{`{"a":{"b":{"c":{}}}}`, JSONLimits{MaxDepth: 3}, false},
+		{`[[[[1]]]]`, JSONLimits{MaxDepth: 3}, false},
+		{`{"list":[1,2,3]}`, JSONLimits{MaxArrayLength: 3}, true},
+		{`{"list":[1,2,3,4]}`, JSONLimits{MaxArrayLength: 3}, false},
+		{`{"list":[[1],[2],{"x":[1,2]}]}`, JSONLimits{MaxArrayLength: 3}, true},
+		{`{"a":1,"b":2,"c":3,"d":4}`, JSONLimits{MaxArrayLength: 3}, true}, // objects aren't arrays
+		{`"scalar"`, JSONLimits{MaxDepth: 1}, true},
+	}
+	for _, tt := range tests {
+		err := checkJSONLimits([]byte(tt.body), tt.limits)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkJSONLimits(%s, %+v) = %v, want ok=%v", tt.body, tt.limits, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrJSONLimit) {
+			t.Errorf("checkJSONLimits(%s): error %v is not ErrJSONLimit", tt.body, err)
+		}
+	}
+}
+
+func TestJSONLimits_DepthAnswers400(t *testing.T) {
+	w := Get()
+	w.SetShowErrors()
+	w.SetJSONLimits(JSONLimits{MaxDepth: 2})
+	called := false
+	AddJsonPOST(w, "/any", func(st map[string]any, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		called = true
+		return "ok", nil, nil
+	})
+
+	rr := postJSON(w, "/any", `{"a":{"b":{"c":1}}}`)
+	if rr.Code != http.StatusBadRequest || called {
+		t.Errorf("status = %d, handler called = %v; want 400 without handler", rr.Code, called)
+	}
+	if !strings.Contains(rr.Body.String(), "nested deeper than 2") {
+		t.Errorf("body = %q", rr.Body.String())
+	}
+}
+
+func TestJSONLimits_StrictAndUseNumber(t *testing.T) {
+	w := Get()
+	AddJsonPOST(w, "/strict", echoTenant).JSONLimits(JSONLimits{DisallowUnknownFields: true})
+
+	var got any
+	AddJsonPOST(w, "/number", func(st map[string]any, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		got = st["id"]
+		return "ok", nil, nil
+	}).JSONLimits(JSONLimits{UseNumber: true})
+
+	if rr := postJSON(w, "/strict", `{"tenant_id":"a","admin":true}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown field: status = %d, want 400", rr.Code)
+	}
+	if rr := postJSON(w, "/strict", `{"tenant_id":"a"}`); rr.Code != http.StatusOK {
+		t.Errorf("known fields: status = %d, want 200", rr.Code)
+	}
+
+	postJSON(w, "/number", `{"id":9007199254740993}`)
+	if n, ok := got.(json.Number); !ok || n.String() != "9007199254740993" {
+		t.Errorf("id = %#v, want json.Number 9007199254740993", got)
+	}
+}
+
+func TestQueryStructMismatchAnswers400(t *testing.T) {
+	w := Get()
+	type filter struct {
+		Tags []string `json:"tags"`
+	}
+	AddGetWithStruct(w, "/search", func(st filter, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	})
+
+	rr := httptest.NewRecorder()
+	w.Run("", httptest.NewRequest(http.MethodGet, "/search?tags=a", nil), rr)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rr.Code)
+	}
+}
@@ -0,0 +1,71 @@
+package wepi
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// SetLogger sets the structured logger wepi writes its records to.
+// The default logger discards everything, so embedding wepi stays silent.
+func (w *WepiController) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	w.update(func(s *settings) { s.logger = logger })
+}
+
+// SetRequestLogLevel sets the level of the per-request record for successful
+// responses (default slog.LevelInfo). 4xx responses are logged at warn, even when
+// wepi returned an error for them, and 5xx responses or errors without an error
+// status at error, unless the level set here is higher.
+func (w *WepiController) SetRequestLogLevel(level slog.Level) {
+	w.update(func(s *settings) { s.requestLogLevel = level })
+}
+
+// requestLevel picks the level of the per-request record from its status; the
+// error only counts when the status doesn't say the request failed (or is missing).
+func (w *WepiController) requestLevel(status int, err error) slog.Level {
+	level := w.cfg().requestLogLevel
+	switch {
+	case status >= http.StatusInternalServerError:
+		level = max(level, slog.LevelError)
+	case status >= http.StatusBadRequest:
+		level = max(level, slog.LevelWarn)
+	case err != nil:
+		level = max(level, slog.LevelError)
+	}
+	return level
+}
+
+// logRequest emits one record describing a handled request.
+func (w *WepiController) logRequest(req *http.Request, info *requestInfo, wr *trackingWriter, duration time.Duration, err error) {
+	level := w.requestLevel(wr.status, err)
+	ctx := req.Context()
+	if !w.cfg().logger.Enabled(ctx, level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("route", info.routeTemplate()),
+		slog.String("method", info.method),
+		slog.String("path", req.URL.Path),
+		slog.Int("status", wr.status),
+		slog.Duration("duration", duration),
+		slog.Int64("bytes", wr.bytes),
+	}
+	if info.requestID != "" {
+		attrs = append(attrs, slog.String("request_id", info.requestID))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+
+	w.cfg().logger.LogAttrs(ctx, level, "request", attrs...)
+}
+
+// logDebug is a shorthand for diagnostics that are only interesting when tracing a problem.
+func (w *WepiController) logDebug(ctx context.Context, msg string, args ...any) {
+	w.cfg().logger.DebugContext(ctx, msg, args...)
+}
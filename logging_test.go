@@ -0,0 +1,148 @@
+package wepi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newBufferLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+func TestRun_LogsRequestRecord(t *testing.T) {
+	w := Get()
+	var buf bytes.Buffer
+	w.SetLogger(newBufferLogger(&buf))
+
+	AddGET[string](w, "/users/{id}", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "hello", nil, nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/users/3", nil)
+	req.Header.Set("X-Request-ID", "abc")
+	w.Run("", req, httptest.NewRecorder())
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("failed to unmarshal log record %q: %v", buf.String(), err)
+	}
+	if record["level"] != "INFO" {
+		t.Errorf("level = %v, want INFO", record["level"])
+	}
+	if record["route"] != "/users/{id}" {
+		t.Errorf("route = %v, want /users/{id}", record["route"])
+	}
+	if record["method"] != http.MethodGet {
+		t.Errorf("method = %v, want GET", record["method"])
+	}
+	if record["status"] != float64(http.StatusOK) {
+		t.Errorf("status = %v, want 200", record["status"])
+	}
+	if record["bytes"] != float64(len("hello")) {
+		t.Errorf("bytes = %v, want %d", record["bytes"], len("hello"))
+	}
+	if record["request_id"] != "abc" {
+		t.Errorf("request_id = %v, want abc", record["request_id"])
+	}
+	if _, ok := record["duration"]; !ok {
+		t.Error("expected duration attribute")
+	}
+}
+
+func TestRun_LogsErrorLevelOnHandlerError(t *testing.T) {
+	w := Get()
+	var buf bytes.Buffer
+	w.SetLogger(newBufferLogger(&buf))
+
+	AddGET[string](w, "/fail", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "", nil, errors.New("db down")
+	})
+
+	w.Run("", httptest.NewRequest(http.MethodGet, "/fail", nil), httptest.NewRecorder())
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("failed to unmarshal log record %q: %v", buf.String(), err)
+	}
+	if record["level"] != "ERROR" {
+		t.Errorf("level = %v, want ERROR", record["level"])
+	}
+	if record["error"] == nil {
+		t.Error("expected error attribute")
+	}
+}
+
+func TestRun_LogsWarnLevelOnBadRequest(t *testing.T) {
+	w := Get()
+	var buf bytes.Buffer
+	w.SetLogger(newBufferLogger(&buf))
+
+	AddJsonPOST(w, "/items", func(st item, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/items", bytes.NewBufferString("{not json"))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("failed to unmarshal log record %q: %v", buf.String(), err)
+	}
+	if rr.Code != http.StatusBadRequest || record["level"] != "WARN" {
+		t.Errorf("status = %d, level = %v, want 400 logged at WARN", rr.Code, record["level"])
+	}
+	if record["error"] == nil {
+		t.Error("expected error attribute")
+	}
+}
+
+func TestRun_UnmatchedRouteNotLogged(t *testing.T) {
+	w := Get()
+	var buf bytes.Buffer
+	w.SetLogger(newBufferLogger(&buf))
+
+	w.Run("", httptest.NewRequest(http.MethodGet, "/missing", nil), httptest.NewRecorder())
+
+	if buf.Len() != 0 {
+		t.Errorf("expected no log output, got %q", buf.String())
+	}
+}
+
+func TestRequestLevel(t *testing.T) {
+	w := Get()
+	w.SetRequestLogLevel(slog.LevelDebug)
+
+	tests := []struct {
+		status int
+		err    error
+		want   slog.Level
+	}{
+		{http.StatusOK, nil, slog.LevelDebug},
+		{http.StatusNotFound, nil, slog.LevelWarn},
+		{http.StatusBadGateway, nil, slog.LevelError},
+		{http.StatusOK, errors.New("x"), slog.LevelError},
+		{0, errors.New("x"), slog.LevelError},
+		{http.StatusBadRequest, errors.New("bad body"), slog.LevelWarn},
+		{http.StatusUnprocessableEntity, errors.New("validation"), slog.LevelWarn},
+		{http.StatusInternalServerError, errors.New("x"), slog.LevelError},
+	}
+	for _, tt := range tests {
+		if got := w.requestLevel(tt.status, tt.err); got != tt.want {
+			t.Errorf("requestLevel(%d, %v) = %v, want %v", tt.status, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultLoggerIsSilent(t *testing.T) {
+	w := Get()
+	if w.cfg().logger.Enabled(t.Context(), slog.LevelError) {
+		t.Error("expected default logger to discard records")
+	}
+}
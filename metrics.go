@@ -0,0 +1,221 @@
+package wepi
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the request duration histogram buckets, in seconds.
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// DefaultSizeBuckets are the response size histogram buckets, in bytes.
+var DefaultSizeBuckets = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+
+// MetricsConfig configures the per-route metrics collected by the controller.
+type MetricsConfig struct {
+	Namespace      string    // metric name prefix, "wepi" if empty
+	LatencyBuckets []float64 // DefaultLatencyBuckets if empty
+	SizeBuckets    []float64 // DefaultSizeBuckets if empty
+}
+
+// metrics collects request counters, in-flight gauges and histograms labelled
+// by route template, method and status class.
+type metrics struct {
+	namespace      string
+	latencyBuckets []float64
+	sizeBuckets    []float64
+
+	mu       sync.Mutex
+	requests map[seriesKey]*requestSeries
+	inFlight map[seriesKey]int64
+}
+
+// seriesKey identifies one label set. Status is empty for in-flight gauges.
+type seriesKey struct {
+	route  string
+	method string
+	status string
+}
+
+type requestSeries struct {
+	count    uint64
+	duration *histogram
+	size     *histogram
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // counts[i] observations <= buckets[i], non-cumulative
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// EnableMetrics starts collecting per-route metrics. Expose them with MetricsHandler.
+func (w *WepiController) EnableMetrics(config MetricsConfig) {
+	m := &metrics{
+		namespace:      config.Namespace,
+		latencyBuckets: sortedBuckets(config.LatencyBuckets, DefaultLatencyBuckets),
+		sizeBuckets:    sortedBuckets(config.SizeBuckets, DefaultSizeBuckets),
+		requests:       make(map[seriesKey]*requestSeries),
+		inFlight:       make(map[seriesKey]int64),
+	}
+	if m.namespace == "" {
+		m.namespace = "wepi"
+	}
+	w.update(func(s *settings) { s.metrics = m })
+}
+
+func sortedBuckets(buckets, def []float64) []float64 {
+	if len(buckets) == 0 {
+		return def
+	}
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	return buckets
+}
+
+// MetricsHandler serves the collected metrics in the Prometheus text exposition format.
+// Metrics are enabled with default settings if EnableMetrics was not called.
+func (w *WepiController) MetricsHandler() http.Handler {
+	m := w.cfg().metrics
+	if m == nil {
+		w.EnableMetrics(MetricsConfig{})
+		m = w.cfg().metrics
+	}
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m.write(wr)
+	})
+}
+
+// start marks a matched request as in flight.
+func (m *metrics) start(info *requestInfo) {
+	key := seriesKey{route: info.routeTemplate(), method: info.method}
+	m.mu.Lock()
+	m.inFlight[key]++
+	m.mu.Unlock()
+}
+
+// observe records a finished request that was counted by start.
+func (m *metrics) observe(info *requestInfo, wr *trackingWriter, duration time.Duration) {
+	key := seriesKey{route: info.routeTemplate(), method: info.method}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inFlight[key]--
+
+	key.status = statusClass(wr.status)
+	s, ok := m.requests[key]
+	if !ok {
+		s = &requestSeries{
+			duration: newHistogram(m.latencyBuckets),
+			size:     newHistogram(m.sizeBuckets),
+		}
+		m.requests[key] = s
+	}
+	s.count++
+	s.duration.observe(duration.Seconds())
+	s.size.observe(float64(wr.bytes))
+}
+
+// statusClass collapses a status code into "2xx", "4xx", ... to bound cardinality.
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func (m *metrics) write(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	requestKeys := sortedKeys(m.requests)
+	inFlightKeys := sortedKeys(m.inFlight)
+
+	name := m.namespace + "_http_requests_total"
+	fmt.Fprintf(out, "# HELP %s Total number of HTTP requests handled.\n# TYPE %s counter\n", name, name)
+	for _, k := range requestKeys {
+		fmt.Fprintf(out, "%s{%s} %d\n", name, k.labels(), m.requests[k].count)
+	}
+
+	name = m.namespace + "_http_requests_in_flight"
+	fmt.Fprintf(out, "# HELP %s Number of HTTP requests currently being handled.\n# TYPE %s gauge\n", name, name)
+	for _, k := range inFlightKeys {
+		fmt.Fprintf(out, "%s{%s} %d\n", name, k.labels(), m.inFlight[k])
+	}
+
+	name = m.namespace + "_http_request_duration_seconds"
+	fmt.Fprintf(out, "# HELP %s Time spent handling HTTP requests.\n# TYPE %s histogram\n", name, name)
+	for _, k := range requestKeys {
+		m.requests[k].duration.write(out, name, k.labels())
+	}
+
+	name = m.namespace + "_http_response_size_bytes"
+	fmt.Fprintf(out, "# HELP %s Size of HTTP response bodies.\n# TYPE %s histogram\n", name, name)
+	for _, k := range requestKeys {
+		m.requests[k].size.write(out, name, k.labels())
+	}
+}
+
+func (h *histogram) write(out io.Writer, name string, labels string) {
+	var cumulative uint64
+	for i, b := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(out, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatFloat(b), cumulative)
+	}
+	fmt.Fprintf(out, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(out, "%s_sum{%s} %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(out, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+func (k seriesKey) labels() string {
+	labels := fmt.Sprintf(`route="%s",method="%s"`, escapeLabel(k.route), escapeLabel(k.method))
+	if k.status != "" {
+		labels += fmt.Sprintf(`,status="%s"`, k.status)
+	}
+	return labels
+}
+
+func sortedKeys[V any](m map[seriesKey]V) []seriesKey {
+	keys := make([]seriesKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b seriesKey) int {
+		return strings.Compare(a.route+"\x00"+a.method+"\x00"+a.status, b.route+"\x00"+b.method+"\x00"+b.status)
+	})
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
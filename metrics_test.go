@@ -0,0 +1,113 @@
+package wepi
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, h http.Handler) string {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("scrape failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want Prometheus text format", ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestMetrics_CountersAndHistograms(t *testing.T) {
+	w := Get()
+	w.EnableMetrics(MetricsConfig{LatencyBuckets: []float64{1, 0.5}, SizeBuckets: []float64{10}})
+
+	AddGET[string](w, "/users/{id}", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "hello", nil, nil
+	})
+	AddGET[string](w, "/missing", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "", Custom().SetStatus(http.StatusNotFound).SetBodyString("no such thing"), nil
+	})
+
+	w.Run("", httptest.NewRequest(http.MethodGet, "/users/1", nil), httptest.NewRecorder())
+	w.Run("", httptest.NewRequest(http.MethodGet, "/users/2", nil), httptest.NewRecorder())
+	w.Run("", httptest.NewRequest(http.MethodGet, "/missing", nil), httptest.NewRecorder())
+	w.Run("", httptest.NewRequest(http.MethodGet, "/unregistered", nil), httptest.NewRecorder())
+
+	body := scrape(t, w.MetricsHandler())
+
+	want := []string{
+		"# TYPE wepi_http_requests_total counter",
+		`wepi_http_requests_total{route="/users/{id}",method="GET",status="2xx"} 2`,
+		`wepi_http_requests_total{route="/missing",method="GET",status="4xx"} 1`,
+		`wepi_http_requests_in_flight{route="/users/{id}",method="GET"} 0`,
+		"# TYPE wepi_http_request_duration_seconds histogram",
+		`wepi_http_request_duration_seconds_bucket{route="/users/{id}",method="GET",status="2xx",le="0.5"} 2`,
+		`wepi_http_request_duration_seconds_count{route="/users/{id}",method="GET",status="2xx"} 2`,
+		`wepi_http_response_size_bytes_bucket{route="/users/{id}",method="GET",status="2xx",le="10"} 2`,
+		`wepi_http_response_size_bytes_bucket{route="/missing",method="GET",status="4xx",le="10"} 0`,
+		`wepi_http_response_size_bytes_bucket{route="/missing",method="GET",status="4xx",le="+Inf"} 1`,
+		`wepi_http_response_size_bytes_sum{route="/users/{id}",method="GET",status="2xx"} 10`,
+	}
+	for _, line := range want {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("scrape missing %q\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, "/unregistered") {
+		t.Error("unmatched paths must not create series")
+	}
+}
+
+func TestMetrics_InFlightDuringHandler(t *testing.T) {
+	w := Get()
+	h := w.MetricsHandler()
+
+	var during string
+	AddGET[string](w, "/slow", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		during = scrape(t, h)
+		return "ok", nil, nil
+	})
+
+	w.Run("", httptest.NewRequest(http.MethodGet, "/slow", nil), httptest.NewRecorder())
+
+	if !strings.Contains(during, `wepi_http_requests_in_flight{route="/slow",method="GET"} 1`) {
+		t.Errorf("expected one in-flight request during the handler, got\n%s", during)
+	}
+}
+
+func TestMetrics_Namespace(t *testing.T) {
+	w := Get()
+	w.EnableMetrics(MetricsConfig{Namespace: "api"})
+
+	AddGET[string](w, "/x", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	})
+	w.Run("", httptest.NewRequest(http.MethodGet, "/x", nil), httptest.NewRecorder())
+
+	if body := scrape(t, w.MetricsHandler()); !strings.Contains(body, `api_http_requests_total{route="/x",method="GET",status="2xx"} 1`) {
+		t.Errorf("expected namespaced counter, got\n%s", body)
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	tests := map[int]string{200: "2xx", 204: "2xx", 301: "3xx", 404: "4xx", 503: "5xx", 0: "unknown"}
+	for status, want := range tests {
+		if got := statusClass(status); got != want {
+			t.Errorf("statusClass(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if got := escapeLabel("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("escapeLabel = %q", got)
+	}
+}
@@ -0,0 +1,60 @@
+package wepi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// ContextMiddleware is a middleware that receives the request context and may return
+// a derived one (or nil to keep ctx), which the next middleware and the handler receive.
+type ContextMiddleware func(ctx context.Context, value any, params ParamsManager, req *http.Request) (context.Context, *CustomResponse, error)
+
+// FromMiddleware lifts a plain middleware so it can be used where a ContextMiddleware is expected.
+func FromMiddleware(middleware func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error)) ContextMiddleware {
+	return func(ctx context.Context, value any, params ParamsManager, req *http.Request) (context.Context, *CustomResponse, error) {
+		c, err := middleware(value, params, req)
+		return ctx, c, err
+	}
+}
+
+// Middleware is a middleware that receives the decoded request struct of its route
+// instead of an untyped value. Adapt it with Typed to pass it to a composer.
+type Middleware[T any] func(st T, params ParamsManager, req *http.Request) (*CustomResponse, error)
+
+// Typed adapts a Middleware[T] to the signature composers accept. T may be the
+// route's struct type or a pointer to it (to modify the value the handler receives).
+// On a route decoding another type the middleware fails the request with a 500.
+func Typed[T any](middleware Middleware[T]) func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+	return func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		st, err := typedValue[T](value)
+		if err != nil {
+			return nil, err
+		}
+		return middleware(st, params, req)
+	}
+}
+
+// typedValue recovers a T from the value Run hands to middlewares, which is the
+// decoded struct wrapped in a reflect.Value.
+func typedValue[T any](value any) (T, error) {
+	var zero T
+	rv, ok := value.(reflect.Value)
+	if !ok {
+		rv = reflect.ValueOf(value)
+	}
+	if !rv.IsValid() {
+		return zero, fmt.Errorf("typed middleware expects %v, route provides no value", reflect.TypeFor[T]())
+	}
+
+	if st, ok := rv.Interface().(T); ok {
+		return st, nil
+	}
+	if rv.CanAddr() {
+		if st, ok := rv.Addr().Interface().(T); ok {
+			return st, nil
+		}
+	}
+	return zero, fmt.Errorf("typed middleware expects %v, route provides %v", reflect.TypeFor[T](), rv.Type())
+}
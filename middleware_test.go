@@ -0,0 +1,121 @@
+package wepi
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type tenantInput struct {
+	TenantID string `json:"tenant_id"`
+	Name     string `json:"name"`
+}
+
+func postJSON(w *WepiController, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+	return rr
+}
+
+func TestTyped_ReceivesDecodedStruct(t *testing.T) {
+	w := Get()
+
+	sameTenant := Typed(func(st tenantInput, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		if st.TenantID != req.Header.Get("X-Tenant") {
+			return Custom().SetStatus(http.StatusForbidden), nil
+		}
+		return nil, nil
+	})
+
+	AddJsonPOST(w, "/items", func(st tenantInput, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "created " + st.Name, nil, nil
+	}, sameTenant)
+
+	rr := postJSON(w, "/items", `{"tenant_id":"acme","name":"x"}`)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestTyped_PointerCanModifyValue(t *testing.T) {
+	w := Get()
+
+	normalize := Typed(func(st *tenantInput, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		st.Name = strings.ToUpper(st.Name)
+		return nil, nil
+	})
+
+	AddJsonPOST(w, "/items", func(st tenantInput, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return st.Name, nil, nil
+	}, normalize)
+
+	rr := postJSON(w, "/items", `{"name":"widget"}`)
+	if rr.Body.String() != "WIDGET" {
+		t.Errorf("body = %q, want WIDGET", rr.Body.String())
+	}
+}
+
+func TestTyped_WrongTypeFailsRequest(t *testing.T) {
+	w := Get()
+
+	type other struct{}
+	mw := Typed(func(st other, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		t.Error("middleware should not run with a mismatched type")
+		return nil, nil
+	})
+
+	AddJsonPOST(w, "/items", func(st tenantInput, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		t.Error("handler should not run")
+		return "", nil, nil
+	}, mw)
+
+	rr := postJSON(w, "/items", `{}`)
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestTyped_ParamsManagerRoute(t *testing.T) {
+	w := Get()
+
+	mw := Typed(func(params2 ParamsManager, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		if params2.GetString("id", "") != "5" {
+			return nil, errors.New("missing id")
+		}
+		return nil, nil
+	})
+
+	AddGET[string](w, "/items/{id}", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	}, mw)
+
+	rr := httptest.NewRecorder()
+	w.Run("", httptest.NewRequest(http.MethodGet, "/items/5", nil), rr)
+	if rr.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestTyped_WithContextComposer(t *testing.T) {
+	w := Get()
+
+	var seen string
+	mw := FromMiddleware(Typed(func(st tenantInput, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		seen = st.TenantID
+		return nil, nil
+	}))
+
+	AddJsonPOSTCtx(w, "/items", func(ctx context.Context, st tenantInput, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	}, mw)
+
+	postJSON(w, "/items", `{"tenant_id":"acme"}`)
+	if seen != "acme" {
+		t.Errorf("seen = %q, want acme", seen)
+	}
+}
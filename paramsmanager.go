@@ -12,6 +12,8 @@ import (
 type ParamsManager struct {
 	data       map[string]any
 	additional map[string]any
+	values     map[any]any // typed values, see Key
+	requestID  string
 }
 
 // GetParamsManager creates a new ParamsManager from the given data map.
@@ -19,6 +21,7 @@ func GetParamsManager(data map[string]any) ParamsManager {
 	return ParamsManager{
 		data:       data,
 		additional: make(map[string]any),
+		values:     make(map[any]any),
 	}
 }
 
@@ -68,6 +71,11 @@ func (p ParamsManager) GetAdditionalData(key string) any {
 	return nil
 }
 
+// RequestID returns the ID of the request being served, or "" if it has none.
+func (p ParamsManager) RequestID() string {
+	return p.requestID
+}
+
 // GetString returns the string value for key s, or def if not found or not a string.
 func (p ParamsManager) GetString(s string, def string) string {
 	if !p.HasKey(s) {
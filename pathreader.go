@@ -1,7 +1,7 @@
 package wepi
 
 import (
-	"log"
+	"fmt"
 	"regexp"
 	"strings"
 )
@@ -15,21 +15,9 @@ type PathReader struct {
 	regex   *regexp.Regexp
 }
 
-func (w *WepiController) addPattern(path string) {
-	w.pathsMutex.Lock()
-	defer w.pathsMutex.Unlock()
-	reg, keys := buildRegexFromTemplate(path)
-	if len(keys) > 0 {
-		w.addRegex(reg, keys, path)
-	}
-}
-
-func (w *WepiController) addRegex(regex *regexp.Regexp, keys []string, pattern string) {
-	w.pathRegexs = append(w.pathRegexs, &PathReader{regex: regex, keys: keys, pattern: pattern})
-}
-
-func (w *WepiController) checkPatternsForPath(path string) (map[string]string, string) {
-	for _, pReader := range w.pathRegexs {
+// checkPatternsForPath matches path against the parameterized templates of the table.
+func (t *routeTable) checkPatternsForPath(path string) (map[string]string, string) {
+	for _, pReader := range t.patterns {
 		m := extractPatternValues(pReader.regex, pReader.keys, path)
 		if m != nil {
 			return m, pReader.pattern
@@ -40,7 +28,8 @@ func (w *WepiController) checkPatternsForPath(path string) (map[string]string, s
 
 // loadRouteFromRequest finds a registered route for the given path and method.
 func (w *WepiController) loadRouteFromRequest(path string, method string) (newPath string, _ *Route, pathPatternParams map[string]string) {
-	pathPatternParams, foundPatternPath := w.checkPatternsForPath(path)
+	t := w.table.Load()
+	pathPatternParams, foundPatternPath := t.checkPatternsForPath(path)
 
 	if foundPatternPath != "" {
 		path = foundPatternPath
@@ -48,17 +37,18 @@ func (w *WepiController) loadRouteFromRequest(path string, method string) (newPa
 		pathPatternParams = nil
 	}
 
-	r, ok := w.routes.Load(path + method)
+	r, ok := t.routes[path+method]
 	if !ok {
 		return "", nil, nil
 	}
 
-	return path, r.(*Route), pathPatternParams
+	return path, r, pathPatternParams
 }
 
-// buildRegexFromTemplate converts a path template like "/users/{id}/posts/{postId}"
-// into a compiled regex and returns the ordered list of parameter names.
-func buildRegexFromTemplate(template string) (*regexp.Regexp, []string) {
+// compileTemplate converts a path template like "/users/{id}/posts/{postId}"
+// into a compiled regex and returns the ordered list of parameter names, or why
+// the template was rejected.
+func compileTemplate(template string) (*regexp.Regexp, []string, error) {
 	re := regexp.MustCompile(`\{([^{}]+)\}`)
 	var keys []string
 
@@ -71,21 +61,19 @@ func buildRegexFromTemplate(template string) (*regexp.Regexp, []string) {
 	pattern = "^" + pattern + "$"
 
 	if len(keys) == 0 {
-		return nil, nil
+		return nil, nil, nil
 	}
 
 	// Reject ambiguous consecutive captures like {a}{b}
 	if strings.Contains(pattern, matcher+matcher) {
-		log.Println("not valid pattern: " + pattern + " for path: " + template)
-		return nil, nil
+		return nil, nil, fmt.Errorf("not valid pattern: %s for path: %s", pattern, template)
 	}
 
 	compiledRe, err := regexp.Compile(pattern)
 	if err != nil {
-		log.Println(err)
-		return nil, nil
+		return nil, nil, err
 	}
-	return compiledRe, keys
+	return compiledRe, keys, nil
 }
 
 // extractPatternValues matches a path against a compiled regex and returns
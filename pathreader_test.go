@@ -5,10 +5,10 @@ import (
 	"testing"
 )
 
-func TestBuildRegexFromTemplate(t *testing.T) {
-	re, keys := buildRegexFromTemplate("/users/{id}")
-	if re == nil {
-		t.Fatal("expected non-nil regex")
+func TestCompileTemplate(t *testing.T) {
+	re, keys, err := compileTemplate("/users/{id}")
+	if re == nil || err != nil {
+		t.Fatalf("compileTemplate = %v, %v; want a regex", re, err)
 	}
 	if len(keys) != 1 || keys[0] != "id" {
 		t.Errorf("keys = %v, want [id]", keys)
@@ -21,9 +21,9 @@ func TestBuildRegexFromTemplate(t *testing.T) {
 	}
 }
 
-func TestBuildRegexFromTemplate_NoParams(t *testing.T) {
-	re, keys := buildRegexFromTemplate("/static/path")
-	if re != nil || keys != nil {
+func TestCompileTemplate_NoParams(t *testing.T) {
+	re, keys, err := compileTemplate("/static/path")
+	if re != nil || keys != nil || err != nil {
 		t.Error("expected nil for template with no params")
 	}
 }
@@ -71,8 +71,8 @@ func TestLoadRouteFromRequest(t *testing.T) {
 	if path == "" {
 		t.Fatal("expected a match")
 	}
-	if r != route {
-		t.Error("expected the registered route")
+	if r == nil || r.origin != route {
+		t.Error("expected the published copy of the registered route")
 	}
 	if params["id"] != "42" {
 		t.Errorf("id = %q, want %q", params["id"], "42")
@@ -83,3 +83,13 @@ func TestLoadRouteFromRequest(t *testing.T) {
 		t.Error("expected no match for wrong method")
 	}
 }
+
+func TestCompileTemplate_RejectsAmbiguousCaptures(t *testing.T) {
+	re, keys, err := compileTemplate("/files/{a}{b}")
+	if err == nil {
+		t.Fatal("expected error for consecutive captures")
+	}
+	if re != nil || keys != nil {
+		t.Errorf("expected no regex or keys, got %v %v", re, keys)
+	}
+}
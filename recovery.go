@@ -0,0 +1,120 @@
+package wepi
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrPanic is wrapped by the error Run returns when a handler or middleware panicked.
+var ErrPanic = errors.New("recovered panic")
+
+// PanicReport describes a panic recovered while serving a request.
+type PanicReport struct {
+	Value          any
+	Stack          []byte
+	Route          string // matched route template, empty if the panic happened before matching
+	Method         string
+	Path           string
+	RequestID      string
+	HeadersWritten bool // the response was already committed, so no 500 could be sent
+	Request        *http.Request
+}
+
+// requestInfo collects what runUnwrapped learns about a request so Run can report on it.
+type requestInfo struct {
+	method    string
+	requestID string
+	route     *Route
+	metrics   *metrics // set once the request is counted as in flight
+
+	tracer trace.Tracer // set when the request is traced
+	span   trace.Span
+}
+
+func (i *requestInfo) routeTemplate() string {
+	if i.route == nil {
+		return ""
+	}
+	return i.route.route
+}
+
+// SetPanicReporter sets the function called with every recovered panic.
+// Without a reporter panics are logged at error level through the controller's logger.
+func (w *WepiController) SetPanicReporter(reporter func(report PanicReport)) {
+	w.update(func(s *settings) { s.panicReporter = reporter })
+}
+
+// SetProblemDetails makes recovered panics answer with an RFC 9457
+// application/problem+json body instead of a bare 500.
+func (w *WepiController) SetProblemDetails() {
+	w.update(func(s *settings) { s.problemDetails = true })
+}
+
+// recoverPanic reports a recovered panic and answers the request with a 500
+// if the response has not been committed yet; otherwise instrument aborts it.
+func (w *WepiController) recoverPanic(rec any, info *requestInfo, req *http.Request, wr *trackingWriter) error {
+	report := PanicReport{
+		Value:          rec,
+		Stack:          debug.Stack(),
+		Route:          info.routeTemplate(),
+		Method:         info.method,
+		Path:           req.URL.Path,
+		RequestID:      info.requestID,
+		HeadersWritten: wr.wroteHeader,
+		Request:        req,
+	}
+
+	if reporter := w.cfg().panicReporter; reporter != nil {
+		reporter(report)
+	} else {
+		w.cfg().logger.ErrorContext(req.Context(), "recovered panic",
+			slog.String("request_id", report.RequestID),
+			slog.String("route", report.Route),
+			slog.String("method", report.Method),
+			slog.String("path", report.Path),
+			slog.Any("panic", rec),
+			slog.String("stack", string(report.Stack)),
+		)
+	}
+
+	// Once the status line is out there is nothing safe left to send
+	if !wr.wroteHeader {
+		w.writePanicResponse(wr, req, rec)
+	}
+
+	return fmt.Errorf("%w: %v", ErrPanic, rec)
+}
+
+func (w *WepiController) writePanicResponse(wr http.ResponseWriter, req *http.Request, rec any) {
+	// Drop headers meant for the response that was being built
+	wr.Header().Del("Content-Type")
+	wr.Header().Del("Content-Length")
+	wr.Header().Del("Content-Disposition")
+
+	if !w.cfg().problemDetails {
+		w.writeError(wr, req, http.StatusInternalServerError, fmt.Sprint(rec))
+		return
+	}
+
+	problem := map[string]any{
+		"type":   "about:blank",
+		"title":  http.StatusText(http.StatusInternalServerError),
+		"status": http.StatusInternalServerError,
+	}
+	if w.ShowErrors() {
+		problem["detail"] = fmt.Sprint(rec)
+	}
+	if id := RequestIDFromContext(req.Context()); id != "" {
+		problem["request_id"] = id
+	}
+	body, _ := Jsonify(problem)
+
+	wr.Header().Set("Content-Type", "application/problem+json")
+	wr.WriteHeader(http.StatusInternalServerError)
+	wr.Write([]byte(body))
+}
@@ -0,0 +1,202 @@
+package wepi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRun_HandlerPanic_Returns500(t *testing.T) {
+	w := Get()
+
+	var report PanicReport
+	w.SetPanicReporter(func(r PanicReport) {
+		report = r
+	})
+
+	AddGET[string](w, "/items/{id}", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		panic("boom")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/items/7", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	rr := httptest.NewRecorder()
+
+	handled, err := w.Run("", req, rr)
+	if !handled {
+		t.Error("expected handled=true after a panic")
+	}
+	if !errors.Is(err, ErrPanic) {
+		t.Errorf("err = %v, want ErrPanic", err)
+	}
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+	if report.Value != "boom" {
+		t.Errorf("report.Value = %v, want boom", report.Value)
+	}
+	if report.Route != "/items/{id}" {
+		t.Errorf("report.Route = %q, want %q", report.Route, "/items/{id}")
+	}
+	if report.RequestID != "req-1" {
+		t.Errorf("report.RequestID = %q, want %q", report.RequestID, "req-1")
+	}
+	if len(report.Stack) == 0 {
+		t.Error("expected stack to be captured")
+	}
+	if report.HeadersWritten {
+		t.Error("expected HeadersWritten=false")
+	}
+}
+
+func TestRun_MiddlewarePanic_Recovered(t *testing.T) {
+	w := Get()
+	w.SetPanicReporter(func(r PanicReport) {})
+
+	middleware := func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		panic(errors.New("middleware failure"))
+	}
+
+	AddGET[string](w, "/mw", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	}, middleware)
+
+	req := httptest.NewRequest(http.MethodGet, "/mw", nil)
+	rr := httptest.NewRecorder()
+
+	_, err := w.Run("", req, rr)
+	if !errors.Is(err, ErrPanic) {
+		t.Errorf("err = %v, want ErrPanic", err)
+	}
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestRun_Panic_ProblemDetails(t *testing.T) {
+	w := Get()
+	w.SetPanicReporter(func(r PanicReport) {})
+	w.SetProblemDetails()
+	w.SetShowErrors()
+
+	AddGET[string](w, "/pd", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		panic("bad state")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/pd", nil)
+	rr := httptest.NewRecorder()
+
+	w.Run("", req, rr)
+
+	if got := rr.Header().Get("Content-Type"); got != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want application/problem+json", got)
+	}
+	var problem map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("failed to unmarshal problem: %v", err)
+	}
+	if problem["status"] != float64(http.StatusInternalServerError) {
+		t.Errorf("status = %v, want 500", problem["status"])
+	}
+	if problem["detail"] != "bad state" {
+		t.Errorf("detail = %v, want %q", problem["detail"], "bad state")
+	}
+}
+
+// runAborting runs req and reports whether Run aborted the response with http.ErrAbortHandler.
+func runAborting(w *WepiController, req *http.Request, wr http.ResponseWriter) (aborted bool) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			if rec != http.ErrAbortHandler {
+				panic(rec)
+			}
+			aborted = true
+		}
+	}()
+	w.Run("", req, wr)
+	return false
+}
+
+func TestRun_PanicAfterHeadersWritten(t *testing.T) {
+	w := Get()
+
+	var report PanicReport
+	w.SetPanicReporter(func(r PanicReport) {
+		report = r
+	})
+
+	AddGET[string](w, "/late", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	})
+
+	// Commit the response from a wrapped writer, then panic
+	rr := httptest.NewRecorder()
+	wr := &panicOnWriteWriter{ResponseWriter: rr}
+	req := httptest.NewRequest(http.MethodGet, "/late", nil)
+
+	if !runAborting(w, req, wr) {
+		t.Fatal("expected Run to abort the committed response")
+	}
+	if !report.HeadersWritten {
+		t.Error("expected HeadersWritten=true")
+	}
+	if rr.Code != http.StatusOK {
+		t.Errorf("status = %d, want committed %d", rr.Code, http.StatusOK)
+	}
+	if strings.Contains(rr.Body.String(), "Internal Server Error") {
+		t.Error("expected no error body after headers were written")
+	}
+}
+
+func TestRun_ErrAbortHandler_Repanics(t *testing.T) {
+	w := Get()
+
+	AddGET[string](w, "/abort", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		panic(http.ErrAbortHandler)
+	})
+
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", rec)
+		}
+	}()
+
+	w.Run("", httptest.NewRequest(http.MethodGet, "/abort", nil), httptest.NewRecorder())
+}
+
+// panicOnWriteWriter commits the status and then panics while writing the body.
+type panicOnWriteWriter struct {
+	http.ResponseWriter
+}
+
+func (p *panicOnWriteWriter) Write(b []byte) (int, error) {
+	p.ResponseWriter.WriteHeader(http.StatusOK)
+	panic("write failed")
+}
+
+func TestRun_PanicAfterHeadersWrittenCutsResponse(t *testing.T) {
+	w := Get()
+	w.SetPanicReporter(func(r PanicReport) {})
+	AddGET(w, "/late", textHandler("partial")).WrapHTTP(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(wr, req)
+			http.NewResponseController(wr).Flush()
+			panic("after the body")
+		})
+	})
+	srv := httptest.NewServer(w.Handler(""))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/late")
+	if err == nil {
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+	}
+	if err == nil {
+		t.Error("the client read a complete response from a handler that panicked")
+	}
+}
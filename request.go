@@ -2,14 +2,15 @@ package wepi
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"reflect"
 )
 
 // readRequestValues parses the incoming request based on method and Content-Type.
-func readRequestValues(req *http.Request, structType reflect.Type) (map[string]any, reflect.Value, error) {
+func (w *WepiController) readRequestValues(req *http.Request, structType reflect.Type, limits JSONLimits) (map[string]any, reflect.Value, error) {
 	if req.Method == http.MethodGet {
 		values := GetURLQuery(req.URL.Query())
 
@@ -23,9 +24,8 @@ func readRequestValues(req *http.Request, structType reflect.Type) (map[string]a
 					return values, stValue, nil
 				}
 			}
-			if err != nil {
-				log.Println(err)
-			}
+			w.logDebug(req.Context(), "query values do not fit the route struct", slog.Any("error", err))
+			return nil, reflect.Value{}, fmt.Errorf("query values do not fit the route struct: %w", err)
 		}
 
 		return values, reflect.Value{}, nil
@@ -34,7 +34,7 @@ func readRequestValues(req *http.Request, structType reflect.Type) (map[string]a
 	// JSON body: decode directly into the expected struct type
 	if req.Header.Get("Content-Type") == "application/json" {
 		stValue := reflect.New(structType)
-		err := json.NewDecoder(req.Body).Decode(stValue.Interface())
+		err := decodeJSON(req.Body, stValue.Interface(), limits)
 		if err != nil {
 			return nil, reflect.Value{}, err
 		}
@@ -56,9 +56,8 @@ func readRequestValues(req *http.Request, structType reflect.Type) (map[string]a
 				return values, stValue, nil
 			}
 		}
-		if err != nil {
-			log.Println(err)
-		}
+		w.logDebug(req.Context(), "form values do not fit the route struct", slog.Any("error", err))
+		return nil, reflect.Value{}, fmt.Errorf("form values do not fit the route struct: %w", err)
 	}
 
 	return values, reflect.Value{}, nil
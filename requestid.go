@@ -0,0 +1,127 @@
+package wepi
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// DefaultRequestIDHeader is the header read and echoed when RequestIDConfig.Header is empty.
+const DefaultRequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds accepted incoming IDs so they can't flood the logs.
+const maxRequestIDLength = 128
+
+// RequestIDConfig configures request ID propagation.
+type RequestIDConfig struct {
+	Header    string        // DefaultRequestIDHeader if empty
+	Generator func() string // NewUUIDv7 if nil; NewULID is also available
+}
+
+type requestIDContextKey struct{}
+
+// EnableRequestID makes every request carry an ID: the incoming header value when
+// it is present and sane, a generated one otherwise. The ID is stored in the request
+// context and ParamsManager, echoed on the response and added to logs and error bodies.
+func (w *WepiController) EnableRequestID(config RequestIDConfig) {
+	if config.Header == "" {
+		config.Header = DefaultRequestIDHeader
+	}
+	if config.Generator == nil {
+		config.Generator = NewUUIDv7
+	}
+	config.Header = http.CanonicalHeaderKey(config.Header)
+	w.update(func(s *settings) { s.requestID = &config })
+}
+
+// RequestIDFromContext returns the request ID stored by the controller, or "".
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// assignRequestID resolves the ID of a request and returns the request carrying it.
+func (w *WepiController) assignRequestID(req *http.Request, wr http.ResponseWriter, info *requestInfo) *http.Request {
+	config := w.cfg().requestID
+	if config == nil {
+		// Without EnableRequestID an incoming ID is still logged, but only if it is sane
+		if id := req.Header.Get(DefaultRequestIDHeader); validRequestID(id) {
+			info.requestID = id
+		}
+		return req
+	}
+
+	id := req.Header.Get(config.Header)
+	if !validRequestID(id) {
+		id = config.Generator()
+	}
+
+	info.requestID = id
+	wr.Header().Set(config.Header, id)
+	return req.WithContext(context.WithValue(req.Context(), requestIDContextKey{}, id))
+}
+
+// validRequestID accepts non-empty printable ASCII IDs of bounded length.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// NewUUIDv7 returns an RFC 9562 version 7 UUID: a millisecond timestamp followed by random bits.
+func NewUUIDv7() string {
+	var u [16]byte
+	rand.Read(u[6:])
+	putMillis(u[:6], time.Now())
+	u[6] = (u[6] & 0x0f) | 0x70 // version 7
+	u[8] = (u[8] & 0x3f) | 0x80 // RFC 9562 variant
+
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewULID returns a ULID: a 48-bit millisecond timestamp and 80 random bits in Crockford base32.
+func NewULID() string {
+	var u [16]byte
+	putMillis(u[:6], time.Now())
+	rand.Read(u[6:])
+
+	// 128 bits encode to 26 characters of 5 bits, the first one carrying only 3
+	hi := binary.BigEndian.Uint64(u[:8])
+	lo := binary.BigEndian.Uint64(u[8:])
+	var buf [26]byte
+	for i := 25; i >= 0; i-- {
+		buf[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(buf[:])
+}
+
+func putMillis(b []byte, t time.Time) {
+	ms := uint64(t.UnixMilli())
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+}
@@ -0,0 +1,193 @@
+package wepi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var uuidV7Pattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRequestID_GeneratedAndPropagated(t *testing.T) {
+	w := Get()
+	w.EnableRequestID(RequestIDConfig{})
+
+	var fromParams, fromContext string
+	AddGET[string](w, "/id", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		fromParams = params.RequestID()
+		fromContext = RequestIDFromContext(req.Context())
+		return "ok", nil, nil
+	})
+
+	rr := httptest.NewRecorder()
+	w.Run("", httptest.NewRequest(http.MethodGet, "/id", nil), rr)
+
+	echoed := rr.Header().Get("X-Request-ID")
+	if !uuidV7Pattern.MatchString(echoed) {
+		t.Fatalf("X-Request-ID = %q, want a UUIDv7", echoed)
+	}
+	if fromParams != echoed || fromContext != echoed {
+		t.Errorf("params=%q context=%q, want both %q", fromParams, fromContext, echoed)
+	}
+}
+
+func TestRequestID_IncomingReusedWithCustomHeader(t *testing.T) {
+	w := Get()
+	w.EnableRequestID(RequestIDConfig{Header: "x-correlation-id", Generator: NewULID})
+
+	AddGET[string](w, "/id", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return params.RequestID(), nil, nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/id", nil)
+	req.Header.Set("X-Correlation-ID", "upstream-123")
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+
+	if got := rr.Header().Get("X-Correlation-ID"); got != "upstream-123" {
+		t.Errorf("echoed = %q, want upstream-123", got)
+	}
+	if rr.Body.String() != "upstream-123" {
+		t.Errorf("body = %q, want upstream-123", rr.Body.String())
+	}
+}
+
+func TestRequestID_InvalidIncomingReplaced(t *testing.T) {
+	w := Get()
+	w.EnableRequestID(RequestIDConfig{Generator: func() string { return "generated" }})
+
+	AddGET[string](w, "/id", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/id", nil)
+	req.Header.Set("X-Request-ID", "bad id\twith spaces")
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+
+	if got := rr.Header().Get("X-Request-ID"); got != "generated" {
+		t.Errorf("X-Request-ID = %q, want generated", got)
+	}
+}
+
+func TestRequestID_DisabledIgnoresInvalidIncoming(t *testing.T) {
+	w := Get()
+	var fromParams string
+	AddGET[string](w, "/id", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		fromParams = params.RequestID()
+		return "ok", nil, nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/id", nil)
+	req.Header.Set("X-Request-ID", strings.Repeat("a\x01", 150))
+	w.Run("", req, httptest.NewRecorder())
+	if fromParams != "" {
+		t.Errorf("RequestID() = %q, want an invalid incoming ID dropped", fromParams)
+	}
+
+	req.Header.Set("X-Request-ID", "abc")
+	w.Run("", req, httptest.NewRecorder())
+	if fromParams != "abc" {
+		t.Errorf("RequestID() = %q, want abc", fromParams)
+	}
+}
+
+func TestRequestID_InLogsAndErrorBodies(t *testing.T) {
+	w := Get()
+	var buf bytes.Buffer
+	w.SetLogger(newBufferLogger(&buf))
+	w.EnableRequestID(RequestIDConfig{Generator: func() string { return "rid-1" }})
+
+	type Input struct {
+		Email string `json:"email" validate:"required"`
+	}
+	AddJsonPOST[Input, string](w, "/validate", func(st Input, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "ok", nil, nil
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+
+	var body map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to unmarshal error body: %v", err)
+	}
+	if body["request_id"] != "rid-1" {
+		t.Errorf("error body request_id = %v, want rid-1", body["request_id"])
+	}
+	if !strings.Contains(buf.String(), `"request_id":"rid-1"`) {
+		t.Errorf("log = %q, want request_id", buf.String())
+	}
+
+	// Every other error body carries it too
+	failing := func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		return nil, errors.New("middleware failed")
+	}
+	AddGET(w, "/handler", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "", nil, errors.New("boom")
+	})
+	AddGET(w, "/middleware", okHandler, failing)
+	AddGET(w, "/panic", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		panic("boom")
+	})
+	malformed := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(`{`))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+	for _, showErrors := range []bool{false, true} {
+		if showErrors {
+			w.SetShowErrors()
+		}
+		for name, req := range map[string]*http.Request{
+			"handler error":    httptest.NewRequest(http.MethodGet, "/handler", nil),
+			"middleware error": httptest.NewRequest(http.MethodGet, "/middleware", nil),
+			"panic":            httptest.NewRequest(http.MethodGet, "/panic", nil),
+			"body error":       malformed(),
+		} {
+			rr := httptest.NewRecorder()
+			w.Run("", req, rr)
+			var body map[string]any
+			if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body["request_id"] != "rid-1" {
+				t.Errorf("%s (ShowErrors %v): status %d, body %q, want JSON with request_id", name, showErrors, rr.Code, rr.Body.String())
+				continue
+			}
+			if shown := body["error"] != http.StatusText(rr.Code); shown != showErrors {
+				t.Errorf("%s (ShowErrors %v): error = %q", name, showErrors, body["error"])
+			}
+		}
+	}
+}
+
+func TestNewUUIDv7_Format(t *testing.T) {
+	a, b := NewUUIDv7(), NewUUIDv7()
+	if !uuidV7Pattern.MatchString(a) {
+		t.Errorf("NewUUIDv7() = %q, not a version 7 UUID", a)
+	}
+	if a == b {
+		t.Error("expected distinct UUIDs")
+	}
+}
+
+func TestNewULID_Format(t *testing.T) {
+	id := NewULID()
+	if !regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`).MatchString(id) {
+		t.Errorf("NewULID() = %q, not a ULID", id)
+	}
+}
+
+func TestNewULID_SortsByTime(t *testing.T) {
+	a := NewULID()
+	time.Sleep(2 * time.Millisecond)
+	if b := NewULID(); b <= a {
+		t.Errorf("expected %q > %q", b, a)
+	}
+}
@@ -0,0 +1,67 @@
+package wepi
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// trackingWriter wraps the http.ResponseWriter passed to Run and records what
+// has been sent to the client, so recovery and logging can act on it afterwards.
+type trackingWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func newTrackingWriter(wr http.ResponseWriter) *trackingWriter {
+	return &trackingWriter{ResponseWriter: wr}
+}
+
+func (t *trackingWriter) WriteHeader(status int) {
+	// Informational responses (except 101) don't commit the final status
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		t.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if !t.wroteHeader {
+		t.status = status
+		t.wroteHeader = true
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *trackingWriter) Write(b []byte) (int, error) {
+	if !t.wroteHeader {
+		t.status = http.StatusOK
+		t.wroteHeader = true
+	}
+	n, err := t.ResponseWriter.Write(b)
+	t.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets handlers that type-assert http.Flusher keep working through the wrapper.
+func (t *trackingWriter) Flush() {
+	if !t.wroteHeader {
+		t.status = http.StatusOK
+		t.wroteHeader = true
+	}
+	http.NewResponseController(t.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController.
+func (t *trackingWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// Hijack records a switch of protocols, e.g. to WebSocket, before handing over the connection.
+func (t *trackingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(t.ResponseWriter).Hijack()
+	if err == nil && !t.wroteHeader {
+		t.status = http.StatusSwitchingProtocols
+		t.wroteHeader = true
+	}
+	return conn, rw, err
+}
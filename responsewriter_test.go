@@ -0,0 +1,43 @@
+package wepi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrackingWriter_RecordsStatusAndBytes(t *testing.T) {
+	rr := httptest.NewRecorder()
+	tw := newTrackingWriter(rr)
+
+	tw.WriteHeader(http.StatusCreated)
+	tw.WriteHeader(http.StatusInternalServerError)
+	tw.Write([]byte("hello"))
+
+	if tw.status != http.StatusCreated {
+		t.Errorf("status = %d, want %d", tw.status, http.StatusCreated)
+	}
+	if tw.bytes != 5 {
+		t.Errorf("bytes = %d, want 5", tw.bytes)
+	}
+}
+
+func TestTrackingWriter_ImplicitOK(t *testing.T) {
+	tw := newTrackingWriter(httptest.NewRecorder())
+
+	tw.Write([]byte("x"))
+
+	if !tw.wroteHeader || tw.status != http.StatusOK {
+		t.Errorf("wroteHeader=%v status=%d, want true %d", tw.wroteHeader, tw.status, http.StatusOK)
+	}
+}
+
+func TestTrackingWriter_InformationalDoesNotCommit(t *testing.T) {
+	tw := newTrackingWriter(httptest.NewRecorder())
+
+	tw.WriteHeader(http.StatusEarlyHints)
+
+	if tw.wroteHeader {
+		t.Error("expected 103 not to commit the response")
+	}
+}
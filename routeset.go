@@ -0,0 +1,110 @@
+package wepi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Registrar is what composers register routes on: a WepiController, which serves
+// them right away, or a RouteSet, which collects them to be published later.
+type Registrar interface {
+	addRoute(converter *WepiComposedRoute)
+}
+
+// RouteSet collects routes off to the side, fully configured, so they can be
+// published in one step with WepiController.Swap or one by one with ReplaceRoute.
+//
+//	set := wepi.NewRouteSet()
+//	wepi.AddGET(set, "/proxy/{name}", GetProxy).With(Auth)
+//	if err := app.Swap(set); err != nil { ... }
+type RouteSet struct {
+	routes []*Route
+	errs   []error
+}
+
+// NewRouteSet creates an empty route set.
+func NewRouteSet() *RouteSet {
+	return &RouteSet{}
+}
+
+func (s *RouteSet) addRoute(converter *WepiComposedRoute) {
+	if err := prepareRoute(converter); err != nil {
+		s.errs = append(s.errs, fmt.Errorf("route %s %s: %w", converter.method, converter.path, err))
+	}
+	s.routes = append(s.routes, converter.route)
+}
+
+// Swap replaces every registered route with the routes of set in one atomic step.
+// Requests already being served finish on the routes they started with. If a
+// route of set has an invalid template or consumes a key no provider sets (see Verify),
+// nothing is published and the error says why. Settings, groups and global
+// middlewares are kept.
+func (w *WepiController) Swap(set *RouteSet) error {
+	if err := errors.Join(set.errs...); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var errs []error
+	for _, route := range set.routes {
+		errs = append(errs, w.cfg().verifyRoute(route))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	t := &routeTable{routes: make(map[string]*Route, len(set.routes))}
+	for _, route := range set.routes {
+		w.publishRoute(t, route)
+	}
+	w.table.Store(t)
+	return nil
+}
+
+// ReplaceRoute publishes route, built on a RouteSet, in place of the route registered
+// for the same method and template, or as a new route if there is none. Unlike
+// registering on the controller directly, the route is only served once all of its
+// options (With, Around, CORS...) are set, and it is refused if it consumes a key
+// no provider sets (see Verify).
+func (w *WepiController) ReplaceRoute(route *Route) error {
+	if route.controller != nil && route.controller != w {
+		return fmt.Errorf("route %s %s belongs to another controller", route.method, route.route)
+	}
+	if _, _, err := compileTemplate(route.route); err != nil {
+		return fmt.Errorf("route %s %s: %w", route.method, route.route, err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.cfg().verifyRoute(route); err != nil {
+		return err
+	}
+	w.updateTable(func(t *routeTable) { w.publishRoute(t, route) })
+	return nil
+}
+
+// RemoveRoute unregisters the route for method and template. It reports whether
+// there was one. PUT removes the POST route that serves it.
+func (w *WepiController) RemoveRoute(method, template string) bool {
+	if method == http.MethodPut {
+		method = http.MethodPost
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.table.Load().routes[template+method]; !ok {
+		return false
+	}
+	w.updateTable(func(t *routeTable) {
+		delete(t.routes, template+method)
+		for _, r := range t.routes {
+			if r.route == template {
+				return // the template still serves another method
+			}
+		}
+		t.patterns = slices.DeleteFunc(slices.Clone(t.patterns), func(p *PathReader) bool { return p.pattern == template })
+	})
+	return true
+}
@@ -0,0 +1,150 @@
+package wepi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func textHandler(body string) func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+	return func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return body, nil, nil
+	}
+}
+
+func get(w *WepiController, path string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	if handled, _ := w.Run("", httptest.NewRequest(http.MethodGet, path, nil), rr); !handled {
+		rr.Code = http.StatusNotFound
+	}
+	return rr
+}
+
+func TestRemoveRoute(t *testing.T) {
+	w := Get()
+	AddGET(w, "/items/{id}", textHandler("get"))
+	AddJsonPOST(w, "/items/{id}", func(st tenantInput, params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "post", nil, nil
+	})
+
+	if !w.RemoveRoute(GET, "/items/{id}") {
+		t.Fatal("RemoveRoute reported no route")
+	}
+	if rr := get(w, "/items/1"); rr.Code != http.StatusNotFound {
+		t.Errorf("removed route still served: %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := postJSON(w, "/items/1", `{}`); rr.Body.String() != "post" {
+		t.Errorf("POST on the same template: body = %q, want post", rr.Body.String())
+	}
+
+	if !w.RemoveRoute(http.MethodPut, "/items/{id}") {
+		t.Error("PUT should remove the POST route")
+	}
+	if len(w.table.Load().patterns) != 0 {
+		t.Error("pattern kept after its last route was removed")
+	}
+	if w.RemoveRoute(GET, "/items/{id}") {
+		t.Error("RemoveRoute reported a route that was already removed")
+	}
+}
+
+func TestReplaceRoute_PublishesFullyConfiguredRoute(t *testing.T) {
+	w := Get()
+	AddGET(w, "/feature", textHandler("v1"))
+
+	set := NewRouteSet()
+	route := AddGET(set, "/feature", textHandler("v2")).Around(func(params ParamsManager, req *http.Request, next func(req *http.Request) *Outcome) *Outcome {
+		o := next(req)
+		o.Value = strings.ToUpper(o.Value.(string))
+		return o
+	})
+
+	if rr := get(w, "/feature"); rr.Body.String() != "v1" {
+		t.Fatalf("route built on a set was published early: %q", rr.Body.String())
+	}
+	if err := w.ReplaceRoute(route); err != nil {
+		t.Fatal(err)
+	}
+	if rr := get(w, "/feature"); rr.Body.String() != "V2" {
+		t.Errorf("body = %q, want V2", rr.Body.String())
+	}
+
+	// Options set after publishing are republished
+	route.Around(func(params ParamsManager, req *http.Request, next func(req *http.Request) *Outcome) *Outcome {
+		return &Outcome{Value: "intercepted"}
+	})
+	if rr := get(w, "/feature"); rr.Body.String() != "INTERCEPTED" {
+		t.Errorf("inner interceptor: body = %q, want INTERCEPTED", rr.Body.String())
+	}
+}
+
+func TestReplaceRoute_OtherController(t *testing.T) {
+	a, b := Get(), Get()
+	route := AddGET(a, "/x", textHandler("a"))
+	if err := b.ReplaceRoute(route); err == nil {
+		t.Error("expected an error for a route of another controller")
+	}
+}
+
+func TestSwap(t *testing.T) {
+	w := Get()
+	AddGET(w, "/old", textHandler("old"))
+
+	set := NewRouteSet()
+	AddGET(set, "/new/{id}", textHandler("new"))
+	if err := w.Swap(set); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := get(w, "/old"); rr.Code != http.StatusNotFound {
+		t.Errorf("/old still served after Swap")
+	}
+	if rr := get(w, "/new/3"); rr.Body.String() != "new" {
+		t.Errorf("/new/3: body = %q, want new", rr.Body.String())
+	}
+}
+
+func TestSwap_InvalidTemplateKeepsTable(t *testing.T) {
+	w := Get()
+	AddGET(w, "/old", textHandler("old"))
+
+	set := NewRouteSet()
+	AddGET(set, "/files/{a}{b}", textHandler("bad"))
+	if err := w.Swap(set); err == nil {
+		t.Fatal("expected an error for an invalid template")
+	}
+	if rr := get(w, "/old"); rr.Body.String() != "old" {
+		t.Errorf("table changed by a failed Swap")
+	}
+}
+
+func TestSwap_InFlightRequestFinishesOnOldTable(t *testing.T) {
+	w := Get()
+	entered, release := make(chan struct{}), make(chan struct{})
+	AddGET(w, "/slow", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		close(entered)
+		<-release
+		return "old", nil, nil
+	}).Around(func(params ParamsManager, req *http.Request, next func(req *http.Request) *Outcome) *Outcome {
+		return next(req)
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- get(w, "/slow") }()
+	<-entered
+
+	set := NewRouteSet()
+	AddGET(set, "/slow", textHandler("new"))
+	if err := w.Swap(set); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	if rr := <-done; rr.Body.String() != "old" {
+		t.Errorf("in-flight request: body = %q, want old", rr.Body.String())
+	}
+	if rr := get(w, "/slow"); rr.Body.String() != "new" {
+		t.Errorf("next request: body = %q, want new", rr.Body.String())
+	}
+}
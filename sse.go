@@ -0,0 +1,191 @@
+package wepi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSSEHeartbeat is how often idle event streams get a comment line unless
+// SetSSEHeartbeat says otherwise, so proxies don't close them.
+const DefaultSSEHeartbeat = 15 * time.Second
+
+// SSEEvent is one Server-Sent Event.
+type SSEEvent[T any] struct {
+	ID    string // sent as the event id; clients send the last one back as Last-Event-ID
+	Event string // event type; "message" if empty
+	Data  T      // strings are sent as is, other values JSON-encoded
+}
+
+// SSEStream sends typed events to one client. Its methods are safe for
+// concurrent use and fail once the client is gone.
+type SSEStream[T any] struct {
+	mu  sync.Mutex
+	wr  http.ResponseWriter
+	rc  *http.ResponseController
+	ctx context.Context
+	err error
+
+	lastEventID string
+}
+
+// streamer is a handler result that writes the response itself.
+type streamer interface {
+	stream(w *WepiController, route *Route, wr http.ResponseWriter, req *http.Request) error
+}
+
+// SetSSEHeartbeat sets how often idle event streams get a heartbeat comment.
+// A negative duration disables heartbeats.
+func (w *WepiController) SetSSEHeartbeat(d time.Duration) {
+	w.update(func(s *settings) { s.sseHeartbeat = d })
+}
+
+// AddSSE registers a GET route streaming Server-Sent Events. Once the middlewares
+// pass, the response is committed as text/event-stream and the handler sends
+// events until it returns or the client disconnects, which cancels ctx.
+// An error returned by the handler ends the stream and is reported like any route error.
+func AddSSE[T any](wepiController Registrar, path string, function func(ctx context.Context, stream *SSEStream[T], params ParamsManager, req *http.Request) error, middlewares ...ContextMiddleware) *Route {
+	ro := AddGETCtx(wepiController, path, func(ctx context.Context, params ParamsManager, req *http.Request) (streamer, *CustomResponse, error) {
+		return sseHandler[T]{function: function, params: params}, nil, nil
+	}, middlewares...)
+	// Compression would hold events back until enough bytes are buffered
+	return ro.SkipCompression()
+}
+
+type sseHandler[T any] struct {
+	function func(ctx context.Context, stream *SSEStream[T], params ParamsManager, req *http.Request) error
+	params   ParamsManager
+}
+
+func (h sseHandler[T]) stream(w *WepiController, route *Route, wr http.ResponseWriter, req *http.Request) error {
+	s := &SSEStream[T]{
+		wr:          wr,
+		rc:          http.NewResponseController(wr),
+		ctx:         req.Context(),
+		lastEventID: req.Header.Get("Last-Event-ID"),
+	}
+
+	hd := wr.Header()
+	hd.Set("Content-Type", "text/event-stream")
+	hd.Set("Cache-Control", "no-cache")
+	hd.Set("X-Accel-Buffering", "no") // nginx would buffer the stream otherwise
+	hd.Del("Content-Length")
+	s.rc.SetWriteDeadline(time.Time{}) // the stream outlives the server's WriteTimeout
+	wr.WriteHeader(http.StatusOK)
+	if err := s.rc.Flush(); err != nil {
+		return err
+	}
+
+	heartbeat := w.cfg().sseHeartbeat
+	if heartbeat == 0 {
+		heartbeat = DefaultSSEHeartbeat
+	}
+	if heartbeat > 0 {
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.heartbeat(heartbeat, done)
+		}()
+		defer wg.Wait()
+		defer close(done)
+	}
+
+	err := h.function(req.Context(), s, h.params, req)
+	if errors.Is(err, context.Canceled) && req.Context().Err() != nil {
+		return nil // the client went away
+	}
+	return err
+}
+
+func (s *SSEStream[T]) heartbeat(every time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+			if s.write(": heartbeat\n\n") != nil {
+				return
+			}
+		}
+	}
+}
+
+// LastEventID returns the Last-Event-ID the client reconnected with, or "".
+func (s *SSEStream[T]) LastEventID() string {
+	return s.lastEventID
+}
+
+// Send sends data as an unnamed event without id.
+func (s *SSEStream[T]) Send(data T) error {
+	return s.SendEvent(SSEEvent[T]{Data: data})
+}
+
+// SendEvent sends one event and flushes it to the client.
+func (s *SSEStream[T]) SendEvent(e SSEEvent[T]) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return fmt.Errorf("wepi: SSE id and event type must be single lines")
+	}
+
+	var data string
+	if str, ok := any(e.Data).(string); ok {
+		data = str
+	} else {
+		b, err := json.Marshal(e.Data)
+		if err != nil {
+			return err
+		}
+		data = string(b)
+	}
+
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	data = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(data)
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// SetRetry tells the client how long to wait before reconnecting.
+func (s *SSEStream[T]) SetRetry(d time.Duration) error {
+	return s.write("retry: " + strconv.FormatInt(d.Milliseconds(), 10) + "\n\n")
+}
+
+func (s *SSEStream[T]) write(chunk string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.ctx.Err(); err != nil {
+		s.err = err
+		return err
+	}
+	if _, err := s.wr.Write([]byte(chunk)); err != nil {
+		s.err = err
+		return err
+	}
+	if err := s.rc.Flush(); err != nil {
+		s.err = err
+		return err
+	}
+	return nil
+}
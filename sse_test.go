@@ -0,0 +1,147 @@
+package wepi
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type deviceStatus struct {
+	ID     string `json:"id"`
+	Online bool   `json:"online"`
+}
+
+func TestSSE_Events(t *testing.T) {
+	w := Get()
+	w.EnableCompression(CompressionConfig{MinSize: 1})
+	AddSSE(w, "/devices/{id}/events", func(ctx context.Context, stream *SSEStream[deviceStatus], params ParamsManager, req *http.Request) error {
+		if err := stream.SetRetry(3 * time.Second); err != nil {
+			return err
+		}
+		id := params.GetString("id", "")
+		stream.Send(deviceStatus{ID: id, Online: true})
+		return stream.SendEvent(SSEEvent[deviceStatus]{ID: "7", Event: "status", Data: deviceStatus{ID: id}})
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/devices/d1/events", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	if handled, err := w.Run("", req, rr); !handled || err != nil {
+		t.Fatalf("Run = %v, %v", handled, err)
+	}
+
+	if ct := rr.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if rr.Header().Get("Cache-Control") != "no-cache" || rr.Header().Get("Content-Encoding") != "" {
+		t.Errorf("headers = %v", rr.Header())
+	}
+	want := "retry: 3000\n\n" +
+		`data: {"id":"d1","online":true}` + "\n\n" +
+		"id: 7\nevent: status\n" + `data: {"id":"d1","online":false}` + "\n\n"
+	if rr.Body.String() != want {
+		t.Errorf("body = %q, want %q", rr.Body.String(), want)
+	}
+	if !rr.Flushed {
+		t.Error("events were not flushed")
+	}
+}
+
+func TestSSE_StringDataAndResume(t *testing.T) {
+	w := Get()
+	AddSSE(w, "/log", func(ctx context.Context, stream *SSEStream[string], params ParamsManager, req *http.Request) error {
+		return stream.SendEvent(SSEEvent[string]{ID: "resumed-after-" + stream.LastEventID(), Data: "line 1\nline 2"})
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/log", nil)
+	req.Header.Set("Last-Event-ID", "41")
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+	if want := "id: resumed-after-41\ndata: line 1\ndata: line 2\n\n"; rr.Body.String() != want {
+		t.Errorf("body = %q, want %q", rr.Body.String(), want)
+	}
+}
+
+func TestSSE_InvalidID(t *testing.T) {
+	w := Get()
+	var sendErr error
+	AddSSE(w, "/bad", func(ctx context.Context, stream *SSEStream[string], params ParamsManager, req *http.Request) error {
+		sendErr = stream.SendEvent(SSEEvent[string]{ID: "a\nb", Data: "x"})
+		return nil
+	})
+	get(w, "/bad")
+	if sendErr == nil {
+		t.Error("an id with a newline was sent")
+	}
+}
+
+func TestSSE_MiddlewareRejects(t *testing.T) {
+	w := Get()
+	called := false
+	AddSSE(w, "/private", func(ctx context.Context, stream *SSEStream[string], params ParamsManager, req *http.Request) error {
+		called = true
+		return nil
+	}, FromMiddleware(requireToken))
+
+	rr := get(w, "/private")
+	if rr.Code != http.StatusUnauthorized || called {
+		t.Errorf("status = %d, called = %v, want 401 without streaming", rr.Code, called)
+	}
+	if rr.Header().Get("Content-Type") == "text/event-stream" {
+		t.Error("rejected request got an event stream")
+	}
+}
+
+func TestSSE_HeartbeatAndDisconnect(t *testing.T) {
+	w := Get()
+	w.SetSSEHeartbeat(10 * time.Millisecond)
+	returned := make(chan error, 1)
+	AddSSE(w, "/events", func(ctx context.Context, stream *SSEStream[string], params ParamsManager, req *http.Request) error {
+		<-ctx.Done()
+		returned <- stream.Send("too late")
+		return ctx.Err()
+	})
+
+	srv := httptest.NewServer(w.Handler(""))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != ": heartbeat\n" {
+		t.Fatalf("first line = %q, %v, want a heartbeat", line, err)
+	}
+
+	cancel()
+	select {
+	case err := <-returned:
+		if err == nil {
+			t.Error("Send succeeded after the client disconnected")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler still running after the client disconnected")
+	}
+}
+
+func TestSSE_Route(t *testing.T) {
+	w := Get()
+	ro := AddSSE(w, "/events", func(ctx context.Context, stream *SSEStream[string], params ParamsManager, req *http.Request) error {
+		return nil
+	})
+	if ro.method != GET || !ro.skipCompression {
+		t.Errorf("method = %s, skipCompression = %v", ro.method, ro.skipCompression)
+	}
+	if rr := get(w, "/events"); !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/event-stream") {
+		t.Errorf("Content-Type = %q", rr.Header().Get("Content-Type"))
+	}
+}
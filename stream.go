@@ -0,0 +1,262 @@
+package wepi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStreamFlushInterval is how often streamed results are flushed unless
+// SetStreamFlushInterval says otherwise.
+const DefaultStreamFlushInterval = 250 * time.Millisecond
+
+var errorType = reflect.TypeFor[error]()
+
+// SetStreamFlushInterval sets how often iterator and channel results are flushed
+// to the client while they are streamed. A negative interval flushes every item.
+func (w *WepiController) SetStreamFlushInterval(d time.Duration) {
+	w.update(func(s *settings) { s.streamFlushInterval = d })
+}
+
+// sequence streams an iter.Seq[T], iter.Seq2[T, error] or receive channel result
+// as a JSON array, or as NDJSON when the client accepts application/x-ndjson.
+type sequence struct {
+	each   func(ctx context.Context, idle func(), yield func(item any, err error) bool)
+	status int
+}
+
+// sequenceOf returns the sequence for a handler result, or nil if it isn't one.
+func sequenceOf(v any) *sequence {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return nil
+	}
+
+	switch t := rv.Type(); t.Kind() {
+	case reflect.Chan:
+		if t.ChanDir()&reflect.RecvDir == 0 || rv.IsNil() {
+			return nil
+		}
+		return &sequence{each: func(ctx context.Context, idle func(), yield func(any, error) bool) {
+			cases := []reflect.SelectCase{
+				{Dir: reflect.SelectRecv, Chan: rv},
+				{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+			}
+			for {
+				item, ok := rv.TryRecv()
+				if !ok && item.IsValid() {
+					return // closed
+				}
+				if !item.IsValid() {
+					idle() // nothing ready: send what we have before waiting
+					var chosen int
+					chosen, item, ok = reflect.Select(cases)
+					if chosen == 1 || !ok {
+						return
+					}
+				}
+				if !yield(item.Interface(), nil) {
+					return
+				}
+			}
+		}}
+
+	case reflect.Func:
+		if rv.IsNil() || t.NumIn() != 1 || t.NumOut() != 0 {
+			return nil
+		}
+		y := t.In(0)
+		if y.Kind() != reflect.Func || y.NumOut() != 1 || y.Out(0).Kind() != reflect.Bool {
+			return nil
+		}
+		if y.NumIn() != 1 && (y.NumIn() != 2 || y.In(1) != errorType) {
+			return nil
+		}
+		return &sequence{each: func(ctx context.Context, idle func(), yield func(any, error) bool) {
+			rv.Call([]reflect.Value{reflect.MakeFunc(y, func(args []reflect.Value) []reflect.Value {
+				var err error
+				if len(args) == 2 && !args[1].IsNil() {
+					err = args[1].Interface().(error)
+				}
+				return []reflect.Value{reflect.ValueOf(yield(args[0].Interface(), err))}
+			})})
+		}}
+	}
+	return nil
+}
+
+// acceptsNDJSON reports whether the Accept header asks for newline-delimited JSON.
+func acceptsNDJSON(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && (mediaType == "application/x-ndjson" || mediaType == "application/jsonl") {
+			return true
+		}
+	}
+	return false
+}
+
+// stream writes the sequence item by item. The response is committed with the
+// first item, so an error before it answers like any route error. An error after
+// it ends the stream: NDJSON gets a last {"error": ...} line, and a JSON array is
+// left unterminated so clients can't mistake it for a complete result.
+func (s *sequence) stream(w *WepiController, route *Route, wr http.ResponseWriter, req *http.Request) error {
+	ndjson := acceptsNDJSON(req.Header.Get("Accept"))
+	interval := w.cfg().streamFlushInterval
+	if interval == 0 {
+		interval = DefaultStreamFlushInterval
+	}
+	rc := http.NewResponseController(wr)
+	ctx := req.Context()
+
+	// A ticker flushes items a slow sequence leaves unsent; mu guards the writer from it
+	var (
+		mu        sync.Mutex
+		started   bool
+		dirty     bool
+		count     int
+		streamErr error
+		lastFlush = time.Now()
+	)
+	start := func() {
+		started = true
+		h := wr.Header()
+		h.Del("Content-Length")
+		if ndjson {
+			h.Set("Content-Type", "application/x-ndjson")
+		} else {
+			h.Set("Content-Type", "application/json")
+		}
+		if s.status != 0 {
+			wr.WriteHeader(s.status)
+		}
+		if !ndjson {
+			_, streamErr = wr.Write([]byte("["))
+		}
+	}
+	flush := func() {
+		if started && dirty && streamErr == nil {
+			if err := rc.Flush(); !errors.Is(err, http.ErrNotSupported) {
+				streamErr = err
+			}
+			dirty = false
+			lastFlush = time.Now()
+		}
+	}
+	idle := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		flush()
+	}
+
+	stopTicker := func() {}
+	if interval > 0 {
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t := time.NewTicker(interval)
+			defer t.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ctx.Done():
+					return
+				case <-t.C:
+					mu.Lock()
+					if time.Since(lastFlush) >= interval {
+						flush()
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+		stopTicker = sync.OnceFunc(func() {
+			close(done)
+			wg.Wait()
+		})
+		defer stopTicker() // if the sequence panics
+	}
+
+	var failed error
+	s.each(ctx, idle, func(item any, err error) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			failed = err
+			return false
+		}
+		if streamErr == nil {
+			streamErr = ctx.Err()
+		}
+		if streamErr != nil {
+			return false
+		}
+		if !started {
+			if start(); streamErr != nil {
+				return false
+			}
+		}
+
+		b, err := json.Marshal(item)
+		if err != nil {
+			failed = err
+			return false
+		}
+		switch {
+		case ndjson:
+			b = append(b, '\n')
+		case count > 0:
+			b = append([]byte(","), b...)
+		}
+		count++
+		if _, streamErr = wr.Write(b); streamErr != nil {
+			return false
+		}
+		dirty = true
+		if interval < 0 || time.Since(lastFlush) >= interval {
+			flush()
+		}
+		return true
+	})
+	stopTicker()
+
+	if failed != nil {
+		if !started {
+			return w.writeOutcome(wr, req, route, &Outcome{Err: failed})
+		}
+		if ndjson {
+			msg := "stream failed"
+			if w.ShowErrors() {
+				msg = failed.Error()
+			}
+			line, _ := json.Marshal(map[string]string{"error": msg})
+			wr.Write(append(line, '\n'))
+		}
+		return fmt.Errorf("stream failed after %d items: %w", count, failed)
+	}
+	if ctx.Err() != nil {
+		return nil // the client went away
+	}
+	if streamErr != nil {
+		return streamErr
+	}
+
+	if !started {
+		start()
+	}
+	if !ndjson {
+		_, err := wr.Write([]byte("]"))
+		return err
+	}
+	return nil
+}
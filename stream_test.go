@@ -0,0 +1,233 @@
+package wepi
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"iter"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getAccept(w *WepiController, path, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+	return rr
+}
+
+func countTo(n int) iter.Seq[item] {
+	return func(yield func(item) bool) {
+		for i := range n {
+			if !yield(item{Name: string(rune('a' + i))}) {
+				return
+			}
+		}
+	}
+}
+
+func TestStream_Seq(t *testing.T) {
+	w := Get()
+	AddGET(w, "/items", func(params ParamsManager, req *http.Request) (iter.Seq[item], *CustomResponse, error) {
+		return countTo(3), nil, nil
+	})
+
+	rr := getAccept(w, "/items", "")
+	if rr.Header().Get("Content-Type") != "application/json" || rr.Body.String() != `[{"name":"a"},{"name":"b"},{"name":"c"}]` {
+		t.Errorf("array: Content-Type = %q, body = %q", rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+
+	rr = getAccept(w, "/items", "application/x-ndjson")
+	if rr.Header().Get("Content-Type") != "application/x-ndjson" || rr.Body.String() != "{\"name\":\"a\"}\n{\"name\":\"b\"}\n{\"name\":\"c\"}\n" {
+		t.Errorf("ndjson: Content-Type = %q, body = %q", rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+}
+
+func TestStream_Empty(t *testing.T) {
+	w := Get()
+	AddGET(w, "/none", func(params ParamsManager, req *http.Request) (iter.Seq[item], *CustomResponse, error) {
+		return countTo(0), Custom().SetHeader("X-Total", "0"), nil
+	})
+
+	rr := getAccept(w, "/none", "")
+	if rr.Code != http.StatusOK || rr.Body.String() != "[]" || rr.Header().Get("X-Total") != "0" {
+		t.Errorf("status = %d, body = %q, headers = %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+	if rr := getAccept(w, "/none", "application/x-ndjson"); rr.Body.Len() != 0 {
+		t.Errorf("ndjson body = %q, want empty", rr.Body.String())
+	}
+}
+
+func TestStream_Seq2Errors(t *testing.T) {
+	boom := errors.New("database gone")
+	w := Get()
+	w.SetShowErrors()
+	AddGET(w, "/late", func(params ParamsManager, req *http.Request) (iter.Seq2[item, error], *CustomResponse, error) {
+		return func(yield func(item, error) bool) {
+			if yield(item{Name: "a"}, nil) {
+				yield(item{}, boom)
+			}
+		}, nil, nil
+	})
+	AddGET(w, "/early", func(params ParamsManager, req *http.Request) (iter.Seq2[item, error], *CustomResponse, error) {
+		return func(yield func(item, error) bool) {
+			yield(item{}, boom)
+		}, nil, nil
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/late", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	rr := httptest.NewRecorder()
+	_, err := w.Run("", req, rr)
+	if !errors.Is(err, boom) {
+		t.Errorf("Run error = %v, want it to wrap the stream error", err)
+	}
+	if rr.Code != http.StatusOK || rr.Body.String() != "{\"name\":\"a\"}\n{\"error\":\"database gone\"}\n" {
+		t.Errorf("ndjson: status = %d, body = %q", rr.Code, rr.Body.String())
+	}
+
+	if rr := getAccept(w, "/late", ""); rr.Body.String() != `[{"name":"a"}` {
+		t.Errorf("array body = %q, want it left unterminated", rr.Body.String())
+	}
+
+	rr = getAccept(w, "/early", "")
+	if rr.Code != http.StatusInternalServerError || rr.Body.String() != "database gone" {
+		t.Errorf("error before the first item: status = %d, body = %q, want 500", rr.Code, rr.Body.String())
+	}
+}
+
+func TestStream_Channel(t *testing.T) {
+	w := Get()
+	AddGET(w, "/feed", func(params ParamsManager, req *http.Request) (<-chan item, *CustomResponse, error) {
+		ch := make(chan item)
+		go func() {
+			defer close(ch)
+			for _, n := range []string{"x", "y"} {
+				select {
+				case ch <- item{Name: n}:
+				case <-req.Context().Done():
+					return
+				}
+			}
+		}()
+		return ch, Custom().SetStatus(http.StatusAccepted), nil
+	})
+
+	rr := getAccept(w, "/feed", "")
+	if rr.Code != http.StatusAccepted || rr.Body.String() != `[{"name":"x"},{"name":"y"}]` {
+		t.Errorf("status = %d, body = %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestStream_FlushesAndStopsOnDisconnect(t *testing.T) {
+	w := Get()
+	stopped := make(chan struct{})
+	AddGET(w, "/forever", func(params ParamsManager, req *http.Request) (iter.Seq[int], *CustomResponse, error) {
+		return func(yield func(int) bool) {
+			defer close(stopped)
+			for i := 0; ; i++ {
+				if !yield(i) {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}, nil, nil
+	})
+
+	srv := httptest.NewServer(w.Handler(""))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/forever", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The first lines arrive before the sequence ends, through periodic flushes
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "0\n" {
+		t.Fatalf("first line = %q, %v", line, err)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sequence still running after the client disconnected")
+	}
+}
+
+func TestSequenceOf(t *testing.T) {
+	if sequenceOf(countTo(1)) == nil {
+		t.Error("iter.Seq not recognized")
+	}
+	if sequenceOf(make(chan int)) == nil {
+		t.Error("channel not recognized")
+	}
+	for _, v := range []any{nil, "text", func() {}, func(func(int, string) bool) {}, make(chan<- int), strings.NewReader("")} {
+		if sequenceOf(v) != nil {
+			t.Errorf("sequenceOf(%T) recognized a non-sequence", v)
+		}
+	}
+}
+
+func TestAcceptsNDJSON(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                     false,
+		"application/json":     false,
+		"application/x-ndjson": true,
+		"application/json, application/jsonl;q=0.9": true,
+		"*/*": false,
+	} {
+		if got := acceptsNDJSON(accept); got != want {
+			t.Errorf("acceptsNDJSON(%q) = %v, want %v", accept, got, want)
+		}
+	}
+}
+
+func TestStream_FlushesSlowIterator(t *testing.T) {
+	w := Get()
+	w.SetStreamFlushInterval(20 * time.Millisecond)
+	release := make(chan struct{})
+	AddGET(w, "/slow", func(params ParamsManager, req *http.Request) (iter.Seq[int], *CustomResponse, error) {
+		return func(yield func(int) bool) {
+			if !yield(1) {
+				return
+			}
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+			}
+			yield(2)
+		}, nil, nil
+	})
+	srv := httptest.NewServer(w.Handler(""))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/slow", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "1\n" {
+		t.Fatalf("first line = %q, %v", line, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("first item arrived after %v, only once the second was yielded", elapsed)
+	}
+	close(release)
+}
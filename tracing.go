@@ -0,0 +1,128 @@
+package wepi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/MBFiltering/wepi"
+
+// TracingConfig configures the OpenTelemetry spans started by the controller.
+type TracingConfig struct {
+	TracerProvider trace.TracerProvider          // otel.GetTracerProvider() if nil
+	Propagator     propagation.TextMapPropagator // W3C traceparent/tracestate if nil
+}
+
+type tracing struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// EnableTracing starts a server span for every matched request, continuing the
+// trace from the incoming traceparent/tracestate headers. Middlewares and the
+// handler run in child spans.
+func (w *WepiController) EnableTracing(config TracingConfig) {
+	provider := config.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	propagator := config.Propagator
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	t := &tracing{
+		tracer:     provider.Tracer(tracerName),
+		propagator: propagator,
+	}
+	w.update(func(s *settings) { s.tracing = t })
+}
+
+// startServerSpan opens the request span once the route is known, so it can be
+// named after the route template. It returns the request carrying the span.
+func (t *tracing) startServerSpan(req *http.Request, info *requestInfo, pathParams map[string]string) *http.Request {
+	ctx := t.propagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", info.method),
+		attribute.String("http.route", info.routeTemplate()),
+		attribute.String("url.path", req.URL.Path),
+	}
+	for k, v := range pathParams {
+		attrs = append(attrs, attribute.String("http.route.param."+k, v))
+	}
+
+	ctx, info.span = t.tracer.Start(ctx, info.method+" "+info.routeTemplate(),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...),
+	)
+	info.tracer = t.tracer
+	return req.WithContext(ctx)
+}
+
+// traced runs fn in a child span of the request span when tracing is enabled.
+// Errors and panics are recorded on the child span; panics keep propagating.
+func (i *requestInfo) traced(req *http.Request, name string, fn func(req *http.Request) error, attrs ...attribute.KeyValue) error {
+	if i.tracer == nil {
+		return fn(req)
+	}
+
+	ctx, span := i.tracer.Start(req.Context(), name, trace.WithAttributes(attrs...))
+	defer func() {
+		if rec := recover(); rec != nil {
+			recordPanic(span, rec)
+			span.End()
+			panic(rec)
+		}
+	}()
+
+	err := fn(req.WithContext(ctx))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return err
+}
+
+// restoreSpan makes the request span current again in a context derived inside a
+// middleware, whose own span has ended by the time the context is passed on.
+func (i *requestInfo) restoreSpan(ctx context.Context) context.Context {
+	if i.span == nil {
+		return ctx
+	}
+	return trace.ContextWithSpan(ctx, i.span)
+}
+
+// endServerSpan records the outcome of the request and ends its span.
+func (i *requestInfo) endServerSpan(wr *trackingWriter, rec any, err error) {
+	if i.span == nil {
+		return
+	}
+
+	i.span.SetAttributes(attribute.Int("http.response.status_code", wr.status))
+	switch {
+	case rec != nil:
+		recordPanic(i.span, rec)
+	case err != nil:
+		i.span.RecordError(err)
+		i.span.SetStatus(codes.Error, err.Error())
+	case wr.status >= http.StatusInternalServerError:
+		i.span.SetStatus(codes.Error, http.StatusText(wr.status))
+	}
+	i.span.End()
+}
+
+func recordPanic(span trace.Span, rec any) {
+	span.RecordError(fmt.Errorf("%w: %v", ErrPanic, rec), trace.WithAttributes(
+		attribute.String("exception.stacktrace", string(debug.Stack())),
+	))
+	span.SetStatus(codes.Error, fmt.Sprint("panic: ", rec))
+}
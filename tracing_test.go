@@ -0,0 +1,145 @@
+package wepi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func setupTracing(w *WepiController) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	w.EnableTracing(TracingConfig{TracerProvider: provider})
+	return exporter
+}
+
+func spanAttr(span tracetest.SpanStub, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func findSpan(spans tracetest.SpanStubs, name string) (tracetest.SpanStub, bool) {
+	for _, s := range spans {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+func TestTracing_ServerSpanWithChildren(t *testing.T) {
+	w := Get()
+	exporter := setupTracing(w)
+
+	var handlerSpan trace.SpanContext
+	middleware := func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		return nil, nil
+	}
+	AddGET[string](w, "/devices/{id}", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		handlerSpan = trace.SpanContextFromContext(req.Context())
+		return "ok", nil, nil
+	}, middleware)
+
+	req := httptest.NewRequest(http.MethodGet, "/devices/42", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w.Run("", req, httptest.NewRecorder())
+
+	spans := exporter.GetSpans()
+	server, ok := findSpan(spans, "GET /devices/{id}")
+	if !ok {
+		t.Fatalf("server span not found in %v", spans)
+	}
+	if server.SpanKind != trace.SpanKindServer {
+		t.Errorf("kind = %v, want server", server.SpanKind)
+	}
+	if got := server.Parent.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("parent trace id = %s, want the traceparent one", got)
+	}
+	if v, _ := spanAttr(server, "http.route.param.id"); v.AsString() != "42" {
+		t.Errorf("path param attribute = %q, want 42", v.AsString())
+	}
+	if v, _ := spanAttr(server, "http.response.status_code"); v.AsInt64() != http.StatusOK {
+		t.Errorf("status attribute = %d, want 200", v.AsInt64())
+	}
+
+	for _, name := range []string{"middleware", "handler"} {
+		child, ok := findSpan(spans, name)
+		if !ok {
+			t.Fatalf("%s span not found", name)
+		}
+		if child.Parent.SpanID() != server.SpanContext.SpanID() {
+			t.Errorf("%s span parent = %s, want server span", name, child.Parent.SpanID())
+		}
+	}
+	handler, _ := findSpan(spans, "handler")
+	if handlerSpan.SpanID() != handler.SpanContext.SpanID() {
+		t.Error("expected the handler request context to carry the handler span")
+	}
+}
+
+func TestTracing_HandlerErrorRecorded(t *testing.T) {
+	w := Get()
+	exporter := setupTracing(w)
+
+	AddGET[string](w, "/fail", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		return "", nil, errors.New("db down")
+	})
+
+	w.Run("", httptest.NewRequest(http.MethodGet, "/fail", nil), httptest.NewRecorder())
+
+	spans := exporter.GetSpans()
+	for _, name := range []string{"handler", "GET /fail"} {
+		s, ok := findSpan(spans, name)
+		if !ok {
+			t.Fatalf("%s span not found", name)
+		}
+		if s.Status.Code != codes.Error {
+			t.Errorf("%s status = %v, want error", name, s.Status.Code)
+		}
+	}
+}
+
+func TestTracing_PanicRecorded(t *testing.T) {
+	w := Get()
+	w.SetPanicReporter(func(r PanicReport) {})
+	exporter := setupTracing(w)
+
+	AddGET[string](w, "/panic", func(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+		panic("boom")
+	})
+
+	w.Run("", httptest.NewRequest(http.MethodGet, "/panic", nil), httptest.NewRecorder())
+
+	spans := exporter.GetSpans()
+	for _, name := range []string{"handler", "GET /panic"} {
+		s, ok := findSpan(spans, name)
+		if !ok {
+			t.Fatalf("%s span not found", name)
+		}
+		if s.Status.Code != codes.Error || len(s.Events) == 0 {
+			t.Errorf("%s: status = %v, events = %d; want error with exception event", name, s.Status.Code, len(s.Events))
+		}
+	}
+}
+
+func TestTracing_UnmatchedRouteNotTraced(t *testing.T) {
+	w := Get()
+	exporter := setupTracing(w)
+
+	w.Run("", httptest.NewRequest(http.MethodGet, "/nothing", nil), httptest.NewRecorder())
+
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Errorf("expected no spans, got %d", len(spans))
+	}
+}
@@ -0,0 +1,97 @@
+package wepi
+
+import (
+	"net/http"
+	"slices"
+)
+
+// Use registers middlewares that run on every route, before the route's own
+// middlewares, in the order given. They also apply to routes registered earlier.
+// Routes marked Public skip them.
+func (w *WepiController) Use(middlewares ...func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error)) {
+	w.update(func(s *settings) {
+		for _, m := range middlewares {
+			if m != nil {
+				s.middlewares = append(s.middlewares, FromMiddleware(m))
+			}
+		}
+	})
+}
+
+// UseCtx is Use for context-aware middlewares.
+func (w *WepiController) UseCtx(middlewares ...ContextMiddleware) {
+	w.update(func(s *settings) {
+		for _, m := range middlewares {
+			if m != nil {
+				s.middlewares = append(s.middlewares, m)
+			}
+		}
+	})
+}
+
+// UseProviders is Use for providers: their middlewares run on every route and the
+// keys they set count for Verify on every route that isn't Public.
+func (w *WepiController) UseProviders(providers ...*Provider) {
+	w.update(func(s *settings) {
+		for _, p := range providers {
+			s.middlewares = append(s.middlewares, p.middleware)
+			s.provides = append(s.provides, p.keys...)
+		}
+	})
+}
+
+// UseBeforeRouting registers net/http middlewares that wrap every request Run sees,
+// before the route is matched: unmatched paths and CORS preflights go through them
+// too. A middleware that answers without calling the next handler marks the request
+// as handled. The first one added is the outermost.
+func (w *WepiController) UseBeforeRouting(middlewares ...func(http.Handler) http.Handler) {
+	w.update(func(s *settings) { s.beforeRouting = append(s.beforeRouting, middlewares...) })
+}
+
+// Public marks the route as deliberately open: the middlewares registered with Use
+// and the providers of its groups don't run on it. Before-routing hooks and the route's own middlewares still do.
+func (r *Route) Public() *Route {
+	return r.update(func(r *Route) { r.public = true })
+}
+
+// globalMiddlewares returns the controller-wide and group middlewares that apply to
+// route, in that order.
+func (w *WepiController) globalMiddlewares(route *Route) []ContextMiddleware {
+	if route.public {
+		return nil
+	}
+	s := w.cfg()
+	chain := s.middlewares
+	for _, g := range s.groups {
+		if g.contains(route.route) && len(g.middlewares) > 0 {
+			chain = append(slices.Clip(chain), g.middlewares...)
+		}
+	}
+	return chain
+}
+
+// beforeRoutingServe runs route through the before-routing hooks. If a hook answers
+// the request itself, the request counts as handled.
+func (w *WepiController) beforeRoutingServe(req *http.Request, wr http.ResponseWriter, route func(req *http.Request, wr http.ResponseWriter) (bool, error)) (bool, error) {
+	hooks := w.cfg().beforeRouting
+	if len(hooks) == 0 {
+		return route(req, wr)
+	}
+
+	reached := false
+	var handled bool
+	var err error
+	var h http.Handler = http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		reached = true
+		handled, err = route(req, wr)
+	})
+	for i := len(hooks) - 1; i >= 0; i-- {
+		h = hooks[i](h)
+	}
+	h.ServeHTTP(wr, req)
+
+	if !reached {
+		return true, nil
+	}
+	return handled, err
+}
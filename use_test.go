@@ -0,0 +1,129 @@
+package wepi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func requireToken(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+	if req.Header.Get("Authorization") == "" {
+		return Custom().SetStatus(http.StatusUnauthorized), nil
+	}
+	return nil, nil
+}
+
+func okHandler(params ParamsManager, req *http.Request) (string, *CustomResponse, error) {
+	return "ok", nil, nil
+}
+
+func TestUse_AppliesToAllRoutes(t *testing.T) {
+	w := Get()
+	AddGET(w, "/before", okHandler) // registered before Use
+	w.Use(requireToken)
+	AddGET(w, "/after", okHandler)
+
+	for _, path := range []string{"/before", "/after"} {
+		rr := httptest.NewRecorder()
+		w.Run("", httptest.NewRequest(http.MethodGet, path, nil), rr)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want %d", path, rr.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestUse_RunsBeforeRouteMiddlewares(t *testing.T) {
+	w := Get()
+	var order []string
+	mark := func(name string) func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		return func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+			order = append(order, name)
+			return nil, nil
+		}
+	}
+	w.Use(mark("global1"), mark("global2"))
+	w.UseCtx(func(ctx context.Context, value any, params ParamsManager, req *http.Request) (context.Context, *CustomResponse, error) {
+		order = append(order, "globalCtx")
+		return nil, nil, nil
+	})
+	AddGET(w, "/x", okHandler, mark("route"))
+
+	w.Run("", httptest.NewRequest(http.MethodGet, "/x", nil), httptest.NewRecorder())
+
+	if got := strings.Join(order, ","); got != "global1,global2,globalCtx,route" {
+		t.Errorf("order = %s", got)
+	}
+}
+
+func TestPublic_SkipsGlobalMiddlewares(t *testing.T) {
+	w := Get()
+	w.Use(requireToken)
+	routeRan := false
+	AddGET(w, "/health", okHandler, func(value any, params ParamsManager, req *http.Request) (*CustomResponse, error) {
+		routeRan = true
+		return nil, nil
+	}).Public()
+
+	rr := httptest.NewRecorder()
+	w.Run("", httptest.NewRequest(http.MethodGet, "/health", nil), rr)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", rr.Code)
+	}
+	if !routeRan {
+		t.Error("route middleware skipped on a public route")
+	}
+}
+
+func TestUseBeforeRouting_UnmatchedAndPreflight(t *testing.T) {
+	w := Get()
+	w.AddAllowedCORS("https://app.example")
+	AddGET(w, "/x", okHandler)
+
+	var seen []string
+	w.UseBeforeRouting(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+			seen = append(seen, req.Method+" "+req.URL.Path)
+			next.ServeHTTP(wr, req)
+		})
+	})
+
+	handled, _ := w.Run("", httptest.NewRequest(http.MethodGet, "/missing", nil), httptest.NewRecorder())
+	if handled {
+		t.Error("unmatched path reported as handled")
+	}
+
+	pre := httptest.NewRequest(http.MethodOptions, "/x", nil)
+	pre.Header.Set("Origin", "https://app.example")
+	pre.Header.Set("Access-Control-Request-Method", "GET")
+	rr := httptest.NewRecorder()
+	w.Run("", pre, rr)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("preflight status = %d, want 204", rr.Code)
+	}
+
+	if got := strings.Join(seen, ","); got != "GET /missing,OPTIONS /x" {
+		t.Errorf("hook saw %q", got)
+	}
+}
+
+func TestUseBeforeRouting_ShortCircuit(t *testing.T) {
+	w := Get()
+	w.UseBeforeRouting(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+			http.Error(wr, "maintenance", http.StatusServiceUnavailable)
+		})
+	})
+
+	rr := httptest.NewRecorder()
+	handled, err := w.Run("", httptest.NewRequest(http.MethodGet, "/anything", nil), rr)
+
+	if !handled || err != nil {
+		t.Errorf("Run = %v, %v, want true, nil", handled, err)
+	}
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rr.Code)
+	}
+}
@@ -1,9 +1,9 @@
 package wepi
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"reflect"
 	"strings"
 
@@ -12,6 +12,8 @@ import (
 
 var validatorSingleton = validator.New()
 
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 // validateAndExtractRouteFunc extracts the Handler function from a RouteHandler via reflection.
 func validateAndExtractRouteFunc(route *Route) (handlerFunc reflect.Value, structType reflect.Type, err error) {
 	if route.RouteHandler == nil {
@@ -50,8 +52,15 @@ func validateAndExtractRouteFunc(route *Route) (handlerFunc reflect.Value, struc
 	}
 
 	// The first parameter's type is what Run() uses to decide how to parse the request:
-	// if it's ParamsManager → query/form route, otherwise → JSON body deserialized into T
+	// if it's ParamsManager → query/form route, otherwise → JSON body deserialized into T.
+	// Context-aware handlers take a context.Context before it, so look one further.
 	structType = handlerType.In(0)
+	if structType == contextType {
+		if handlerType.NumIn() < 2 {
+			return reflect.Value{}, nil, errors.New("handler function has insufficient parameters")
+		}
+		structType = handlerType.In(1)
+	}
 
 	return handlerFunc, structType, nil
 }
@@ -72,8 +81,8 @@ func getValidationError(er validator.FieldError, mainStruct any) string {
 // validation error. Falls back to the Go field name if no json tag exists.
 func GetJSONFieldName(e validator.FieldError, mainStruct any) (res string) {
 	defer func() {
-		if err := recover(); err != nil {
-			log.Println(err)
+		// Fall back to the Go field name if the namespace can't be walked
+		if recover() != nil {
 			res = e.Field()
 		}
 	}()
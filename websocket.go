@@ -0,0 +1,576 @@
+package wepi
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSocket close codes (RFC 6455 section 7.4.1).
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005 // reported when a close frame has no code, never sent
+	CloseAbnormal        = 1006 // reported when the connection drops without a close frame, never sent
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// DefaultWebSocketMaxMessageSize bounds incoming WebSocket messages unless
+// WebSocketConfig.MaxMessageSize says otherwise.
+const DefaultWebSocketMaxMessageSize = 1 << 20
+
+// DefaultWebSocketMessageQueue is how many incoming messages wait for Read unless
+// WebSocketConfig.MessageQueue says otherwise.
+const DefaultWebSocketMessageQueue = 16
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocketConfig configures WebSocket routes.
+type WebSocketConfig struct {
+	MaxMessageSize int64         // largest message read; DefaultWebSocketMaxMessageSize if 0
+	MessageQueue   int           // messages waiting for Read; DefaultWebSocketMessageQueue if 0
+	PingInterval   time.Duration // keepalive pings; 30s if 0, none if negative
+	PongTimeout    time.Duration // how long after a ping the peer has to answer; 10s if 0
+	WriteTimeout   time.Duration // bound on each write; 10s if 0
+	Subprotocols   []string      // supported Sec-WebSocket-Protocol values, in order of preference
+}
+
+// CloseError reports why a WebSocket connection closed.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("websocket closed: %d", e.Code)
+	}
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// WebSocket is a server-side RFC 6455 connection exchanging JSON messages,
+// In from the client and Out to it. Write and Close are safe for concurrent use.
+type WebSocket[In, Out any] struct {
+	c *wsConn
+}
+
+// SetWebSocket configures the WebSocket routes of the controller.
+func (w *WepiController) SetWebSocket(config WebSocketConfig) {
+	w.update(func(s *settings) { s.webSocket = config })
+}
+
+// AddWebSocket registers a GET route upgrading to WebSocket once the middlewares
+// pass. Browser origins are checked against the route's CORS policy; requests
+// from the same host or without an Origin are accepted. The handler runs until it
+// returns, which closes the connection with CloseNormal, or CloseInternalError if
+// it returned an error. ctx is cancelled when the connection closes.
+func AddWebSocket[In, Out any](wepiController Registrar, path string, function func(ctx context.Context, ws *WebSocket[In, Out], params ParamsManager, req *http.Request) error, middlewares ...ContextMiddleware) *Route {
+	return AddGETCtx(wepiController, path, func(ctx context.Context, params ParamsManager, req *http.Request) (streamer, *CustomResponse, error) {
+		return wsHandler[In, Out]{function: function, params: params}, nil, nil
+	}, middlewares...)
+}
+
+type wsHandler[In, Out any] struct {
+	function func(ctx context.Context, ws *WebSocket[In, Out], params ParamsManager, req *http.Request) error
+	params   ParamsManager
+}
+
+func (h wsHandler[In, Out]) stream(w *WepiController, route *Route, wr http.ResponseWriter, req *http.Request) error {
+	config := w.cfg().webSocket
+	c, err := upgradeWebSocket(wr, req, w.corsPolicyFor(route), config)
+	if c == nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	go func() {
+		<-c.readDone
+		cancel()
+	}()
+
+	c.start()
+	defer c.conn.Close() // also when the handler panics
+	err = h.function(ctx, &WebSocket[In, Out]{c: c}, h.params, req)
+
+	var closeErr *CloseError
+	switch {
+	case c.isClosed() && (err == nil || errors.As(err, &closeErr) || errors.Is(err, context.Canceled)):
+		err = nil // the client closed the connection, or it dropped
+	case err == nil:
+		c.close(CloseNormal, "")
+	default:
+		reason := ""
+		if w.ShowErrors() {
+			reason = err.Error()
+		}
+		c.close(CloseInternalError, reason)
+	}
+	return err
+}
+
+// upgradeWebSocket checks the opening handshake and switches req's connection
+// to WebSocket. When it returns a nil connection, the request has been answered.
+func upgradeWebSocket(wr http.ResponseWriter, req *http.Request, policy *corsPolicy, config WebSocketConfig) (*wsConn, error) {
+	connection, upgrade := strings.Join(req.Header.Values("Connection"), ","), strings.Join(req.Header.Values("Upgrade"), ",")
+	if !hasToken(connection, "upgrade") || !hasToken(upgrade, "websocket") {
+		wr.Header().Set("Upgrade", "websocket")
+		http.Error(wr, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return nil, nil
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		wr.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(wr, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, nil
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(wr, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, nil
+	}
+	if !websocketOriginAllowed(req, policy) {
+		http.Error(wr, "origin not allowed", http.StatusForbidden)
+		return nil, nil
+	}
+
+	subprotocol := ""
+	offered := req.Header.Get("Sec-WebSocket-Protocol")
+	for _, supported := range config.Subprotocols {
+		if subprotocol == "" && hasToken(offered, supported) {
+			subprotocol = supported
+		}
+	}
+
+	conn, rw, err := http.NewResponseController(wr).Hijack()
+	if err != nil {
+		http.Error(wr, "WebSocket needs an HTTP/1.1 connection", http.StatusInternalServerError)
+		return nil, fmt.Errorf("websocket upgrade: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Headers set so far (request ID, CORS, ...) go out with the 101
+	h := wr.Header().Clone()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", websocketAccept(key))
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	h.Write(rw)
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket upgrade: %w", err)
+	}
+
+	return newWSConn(conn, rw.Reader, config, subprotocol), nil
+}
+
+// websocketOriginAllowed accepts requests without an Origin (non-browser
+// clients), same-host origins, and origins the CORS policy allows.
+func websocketOriginAllowed(req *http.Request, policy *corsPolicy) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if _, host, ok := strings.Cut(origin, "://"); ok && strings.EqualFold(host, req.Host) {
+		return true
+	}
+	return policy != nil && policy.allowOrigin(origin, req) != ""
+}
+
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// hasToken reports whether the comma-separated list contains token, ignoring case.
+func hasToken(list, token string) bool {
+	for _, t := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read waits for the next message and decodes it. It returns a *CloseError once
+// the connection is closed and the messages received before are read; a message
+// that isn't valid JSON for In returns the decoding error and leaves the connection
+// open. Up to MessageQueue messages wait for Read while control frames keep being
+// answered; once the queue is full, the connection stops reading until Read takes
+// one, which holds the client back rather than losing messages.
+func (ws *WebSocket[In, Out]) Read() (In, error) {
+	var msg In
+	data, err := ws.c.read()
+	if err != nil {
+		return msg, err
+	}
+	return msg, json.Unmarshal(data, &msg)
+}
+
+// Write sends msg as a JSON text message.
+func (ws *WebSocket[In, Out]) Write(msg Out) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return ws.c.writeFrame(opText, data)
+}
+
+// Close starts the closing handshake with code and reason, waits briefly for the
+// client to answer, and closes the connection.
+func (ws *WebSocket[In, Out]) Close(code int, reason string) error {
+	return ws.c.close(code, reason)
+}
+
+// Subprotocol returns the subprotocol agreed on during the handshake, or "".
+func (ws *WebSocket[In, Out]) Subprotocol() string {
+	return ws.c.subprotocol
+}
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// closeWait bounds how long a closing connection waits for the peer's close frame.
+const closeWait = 2 * time.Second
+
+// wsConn runs the frame protocol. A reader goroutine answers control frames and
+// queues complete messages for read, waiting only when the queue is full; a pinger
+// keeps the connection alive.
+type wsConn struct {
+	conn        net.Conn
+	br          *bufio.Reader
+	subprotocol string
+
+	maxSize      int64
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	writeTimeout time.Duration
+
+	messages chan []byte   // bounded queue; the reader waits while it is full
+	closing  chan struct{} // closed when the server starts closing
+	readDone chan struct{} // closed when the reader stops; readErr is set then
+	readErr  *CloseError
+
+	writeMu   sync.Mutex
+	closeSent bool
+	closeOnce sync.Once
+}
+
+func newWSConn(conn net.Conn, br *bufio.Reader, config WebSocketConfig, subprotocol string) *wsConn {
+	c := &wsConn{
+		conn:         conn,
+		br:           br,
+		subprotocol:  subprotocol,
+		maxSize:      config.MaxMessageSize,
+		pingInterval: config.PingInterval,
+		pongTimeout:  config.PongTimeout,
+		writeTimeout: config.WriteTimeout,
+		closing:      make(chan struct{}),
+		readDone:     make(chan struct{}),
+	}
+	queue := config.MessageQueue
+	if queue <= 0 {
+		queue = DefaultWebSocketMessageQueue
+	}
+	c.messages = make(chan []byte, queue)
+	if c.maxSize == 0 {
+		c.maxSize = DefaultWebSocketMaxMessageSize
+	}
+	if c.pingInterval == 0 {
+		c.pingInterval = 30 * time.Second
+	}
+	if c.pongTimeout == 0 {
+		c.pongTimeout = 10 * time.Second
+	}
+	if c.writeTimeout == 0 {
+		c.writeTimeout = 10 * time.Second
+	}
+	return c
+}
+
+func (c *wsConn) start() {
+	go c.readLoop()
+	if c.pingInterval > 0 {
+		go c.pingLoop()
+	}
+}
+
+func (c *wsConn) isClosed() bool {
+	select {
+	case <-c.readDone:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *wsConn) read() ([]byte, error) {
+	select {
+	case msg := <-c.messages:
+		return msg, nil
+	case <-c.readDone:
+		// Messages are queued before readDone closes: hand them out first
+		select {
+		case msg := <-c.messages:
+			return msg, nil
+		default:
+			return nil, c.readErr
+		}
+	}
+}
+
+func (c *wsConn) pingLoop() {
+	t := time.NewTicker(c.pingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.readDone:
+			return
+		case <-c.closing:
+			return
+		case <-t.C:
+			if c.writeFrame(opPing, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLoop reads frames until the connection closes, then records why.
+func (c *wsConn) readLoop() {
+	err := c.readMessages()
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) {
+		closeErr = &CloseError{Code: CloseAbnormal, Reason: err.Error()}
+	}
+	c.readErr = closeErr
+	c.conn.Close()
+	close(c.readDone)
+}
+
+func (c *wsConn) readMessages() error {
+	var (
+		msgOp byte
+		msg   []byte
+	)
+	for {
+		if c.pingInterval > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.pingInterval + c.pongTimeout))
+		}
+		fin, op, payload, err := c.readFrame(int64(len(msg)))
+		if err != nil {
+			return c.fail(err)
+		}
+
+		switch op {
+		case opPing:
+			c.writeFrame(opPong, payload)
+			continue
+		case opPong:
+			continue // the read deadline was moved forward already
+		case opClose:
+			return c.closeReceived(payload)
+		case opText, opBinary:
+			if msgOp != 0 {
+				return c.fail(&CloseError{CloseProtocolError, "expected a continuation frame"})
+			}
+			msgOp, msg = op, payload
+		case opContinuation:
+			if msgOp == 0 {
+				return c.fail(&CloseError{CloseProtocolError, "unexpected continuation frame"})
+			}
+			msg = append(msg, payload...)
+		default:
+			return c.fail(&CloseError{CloseProtocolError, "unknown opcode"})
+		}
+		if !fin {
+			continue
+		}
+
+		if msgOp == opText && !utf8.Valid(msg) {
+			return c.fail(&CloseError{CloseInvalidPayload, "invalid UTF-8"})
+		}
+		select {
+		case c.messages <- msg:
+		case <-c.closing: // the handler is done reading; keep waiting for the close frame
+		}
+		msgOp, msg = 0, nil
+	}
+}
+
+// readFrame reads one client frame; buffered is the size of the message so far.
+func (c *wsConn) readFrame(buffered int64) (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.br, head[:]); err != nil {
+		return
+	}
+	fin, op = head[0]&0x80 != 0, head[0]&0x0f
+	if head[0]&0x70 != 0 {
+		return fin, op, nil, &CloseError{CloseProtocolError, "reserved bits set"}
+	}
+	if head[1]&0x80 == 0 {
+		return fin, op, nil, &CloseError{CloseProtocolError, "client frames must be masked"}
+	}
+
+	n := int64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		n = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		if ext[0]&0x80 != 0 {
+			return fin, op, nil, &CloseError{CloseProtocolError, "invalid length"}
+		}
+		n = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if op >= opClose && (!fin || n > 125) {
+		return fin, op, nil, &CloseError{CloseProtocolError, "invalid control frame"}
+	}
+	if op < opClose && buffered+n > c.maxSize {
+		return fin, op, nil, &CloseError{CloseMessageTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// fail sends a close frame for protocol errors before the connection is dropped.
+func (c *wsConn) fail(err error) error {
+	var closeErr *CloseError
+	if errors.As(err, &closeErr) {
+		c.writeClose(closeErr.Code, closeErr.Reason)
+	}
+	return err
+}
+
+// closeReceived answers the client's close frame with the same code.
+func (c *wsConn) closeReceived(payload []byte) error {
+	code, reason := CloseNoStatus, ""
+	switch {
+	case len(payload) == 1:
+		return c.fail(&CloseError{CloseProtocolError, "invalid close frame"})
+	case len(payload) >= 2:
+		code, reason = int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+		if !validCloseCode(code) {
+			return c.fail(&CloseError{CloseProtocolError, "invalid close code"})
+		}
+		if !utf8.ValidString(reason) {
+			return c.fail(&CloseError{CloseInvalidPayload, "invalid UTF-8"})
+		}
+	}
+	echo := code
+	if code == CloseNoStatus {
+		echo = CloseNormal
+	}
+	c.writeClose(echo, "")
+	return &CloseError{Code: code, Reason: reason}
+}
+
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// close sends a close frame, waits for the client's one, and drops the connection.
+func (c *wsConn) close(code int, reason string) error {
+	c.closeOnce.Do(func() { close(c.closing) })
+	err := c.writeClose(code, reason)
+	select {
+	case <-c.readDone:
+	case <-time.After(closeWait):
+		c.conn.Close()
+		<-c.readDone
+	}
+	return err
+}
+
+func (c *wsConn) writeClose(code int, reason string) error {
+	if len(reason) > 123 {
+		reason = reason[:123]
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return c.writeFrame(opClose, append(payload, reason...))
+}
+
+var errWebSocketClosed = &CloseError{Code: CloseNormal, Reason: "connection is closing"}
+
+// writeFrame writes one unmasked, unfragmented frame.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return errWebSocketClosed
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|op)
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 127), uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
@@ -0,0 +1,451 @@
+package wepi
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type command struct {
+	Action string `json:"action"`
+}
+
+type reply struct {
+	Device string `json:"device"`
+	Done   string `json:"done"`
+}
+
+// wsClient speaks just enough RFC 6455 to drive the server in tests.
+type wsClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialWS(t *testing.T, srv *httptest.Server, path string, headers ...string) (*wsClient, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := "GET " + path + " HTTP/1.1\r\nHost: " + srv.Listener.Addr().String() + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"
+	for i := 0; i+1 < len(headers); i += 2 {
+		req += headers[i] + ": " + headers[i+1] + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &wsClient{conn: conn, br: br}, resp
+}
+
+func (c *wsClient) sendFrame(fin bool, op byte, payload []byte, masked bool) {
+	b0 := op
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, maskBit|126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, maskBit|127), uint64(n))
+	}
+	if masked {
+		mask := []byte{1, 2, 3, 4}
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	c.conn.Write(frame)
+}
+
+func (c *wsClient) send(op byte, payload string) {
+	c.sendFrame(true, op, []byte(payload), true)
+}
+
+func (c *wsClient) sendClose(code int) {
+	c.sendFrame(true, opClose, binary.BigEndian.AppendUint16(nil, uint16(code)), true)
+}
+
+// recv reads one server frame, failing if it is masked or fragmented.
+func (c *wsClient) recv(t *testing.T) (byte, []byte) {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	if head[0]&0x80 == 0 || head[1]&0x80 != 0 {
+		t.Fatalf("server frame header %x: want FIN set and no mask", head)
+	}
+	n := int(head[1] & 0x7f)
+	if n == 126 {
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		t.Fatalf("reading payload: %v", err)
+	}
+	return head[0] & 0x0f, payload
+}
+
+// recvClose reads frames up to a close frame and returns its code.
+func (c *wsClient) recvClose(t *testing.T) int {
+	t.Helper()
+	for {
+		op, payload := c.recv(t)
+		if op == opClose {
+			if len(payload) < 2 {
+				return CloseNoStatus
+			}
+			return int(binary.BigEndian.Uint16(payload))
+		}
+	}
+}
+
+func wsServer(t *testing.T, w *WepiController) *httptest.Server {
+	srv := httptest.NewServer(w.Handler(""))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func echoDevice(ctx context.Context, ws *WebSocket[command, reply], params ParamsManager, req *http.Request) error {
+	for {
+		cmd, err := ws.Read()
+		if err != nil {
+			return err
+		}
+		if err := ws.Write(reply{Device: params.GetString("id", ""), Done: cmd.Action}); err != nil {
+			return err
+		}
+	}
+}
+
+func TestWebSocket_Echo(t *testing.T) {
+	w := Get()
+	returned := make(chan error, 1)
+	AddWebSocket(w, "/devices/{id}/control", func(ctx context.Context, ws *WebSocket[command, reply], params ParamsManager, req *http.Request) error {
+		err := echoDevice(ctx, ws, params, req)
+		returned <- err
+		return err
+	}, FromMiddleware(requireToken))
+	srv := wsServer(t, w)
+
+	c, resp := dialWS(t, srv, "/devices/d7/control", "Authorization", "Bearer x")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	// The example handshake of RFC 6455 section 1.3
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept = %q", got)
+	}
+
+	c.send(opText, `{"action":"reboot"}`)
+	op, payload := c.recv(t)
+	if op != opText || string(payload) != `{"device":"d7","done":"reboot"}` {
+		t.Errorf("reply = %x %s", op, payload)
+	}
+
+	// A message split over frames, with a ping in between
+	c.sendFrame(false, opText, []byte(`{"action":`), true)
+	c.send(opPing, "hi")
+	c.sendFrame(true, opContinuation, []byte(`"lock"}`), true)
+	if op, payload := c.recv(t); op != opPong || string(payload) != "hi" {
+		t.Errorf("pong = %x %q", op, payload)
+	}
+	if _, payload := c.recv(t); string(payload) != `{"device":"d7","done":"lock"}` {
+		t.Errorf("fragmented reply = %s", payload)
+	}
+
+	c.sendClose(CloseGoingAway)
+	if code := c.recvClose(t); code != CloseGoingAway {
+		t.Errorf("echoed close code = %d, want %d", code, CloseGoingAway)
+	}
+	select {
+	case err := <-returned:
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != CloseGoingAway {
+			t.Errorf("Read error = %v, want a CloseError with code %d", err, CloseGoingAway)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not return after the close handshake")
+	}
+}
+
+func TestWebSocket_HandshakeRejections(t *testing.T) {
+	w := Get()
+	w.SetCORS(CORSConfig{AllowedOrigins: []string{"https://app.example.com"}})
+	AddWebSocket(w, "/ws", echoDevice)
+	AddWebSocket(w, "/private", echoDevice, FromMiddleware(requireToken))
+	srv := wsServer(t, w)
+
+	if rr := get(w, "/ws"); rr.Code != http.StatusUpgradeRequired || rr.Header().Get("Upgrade") != "websocket" {
+		t.Errorf("plain GET: status = %d, want 426", rr.Code)
+	}
+	if _, resp := dialWS(t, srv, "/private"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without token: status = %d, want 401 from the middleware", resp.StatusCode)
+	}
+	if _, resp := dialWS(t, srv, "/ws", "Origin", "https://evil.example"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("foreign origin: status = %d, want 403", resp.StatusCode)
+	}
+	if _, resp := dialWS(t, srv, "/ws", "Origin", "https://app.example.com"); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("allowed origin: status = %d, want 101", resp.StatusCode)
+	}
+	if _, resp := dialWS(t, srv, "/ws", "Origin", "http://"+srv.Listener.Addr().String()); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("same-host origin: status = %d, want 101", resp.StatusCode)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	rr := httptest.NewRecorder()
+	w.Run("", req, rr)
+	if rr.Code != http.StatusUpgradeRequired || rr.Header().Get("Sec-WebSocket-Version") != "13" {
+		t.Errorf("old version: status = %d, Sec-WebSocket-Version = %q", rr.Code, rr.Header().Get("Sec-WebSocket-Version"))
+	}
+}
+
+func TestWebSocket_ProtocolErrors(t *testing.T) {
+	w := Get()
+	w.SetWebSocket(WebSocketConfig{MaxMessageSize: 16})
+	AddWebSocket(w, "/ws", echoDevice)
+	srv := wsServer(t, w)
+
+	tests := []struct {
+		name string
+		send func(c *wsClient)
+		code int
+	}{
+		{"too big", func(c *wsClient) { c.send(opText, `{"action":"`+strings.Repeat("x", 20)+`"}`) }, CloseMessageTooBig},
+		{"too big over fragments", func(c *wsClient) {
+			c.sendFrame(false, opText, []byte("0123456789"), true)
+			c.sendFrame(true, opContinuation, []byte("0123456789"), true)
+		}, CloseMessageTooBig},
+		{"unmasked", func(c *wsClient) { c.sendFrame(true, opText, []byte("{}"), false) }, CloseProtocolError},
+		{"invalid UTF-8", func(c *wsClient) { c.send(opText, "\xff\xfe") }, CloseInvalidPayload},
+		{"reserved opcode", func(c *wsClient) { c.send(0x3, "") }, CloseProtocolError},
+		{"stray continuation", func(c *wsClient) { c.sendFrame(true, opContinuation, []byte("x"), true) }, CloseProtocolError},
+		{"invalid close code", func(c *wsClient) { c.sendClose(1005) }, CloseProtocolError},
+	}
+	for _, tt := range tests {
+		c, resp := dialWS(t, srv, "/ws")
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("%s: status = %d", tt.name, resp.StatusCode)
+		}
+		tt.send(c)
+		if code := c.recvClose(t); code != tt.code {
+			t.Errorf("%s: close code = %d, want %d", tt.name, code, tt.code)
+		}
+	}
+}
+
+func TestWebSocket_HandlerReturn(t *testing.T) {
+	w := Get()
+	AddWebSocket(w, "/done", func(ctx context.Context, ws *WebSocket[command, reply], params ParamsManager, req *http.Request) error {
+		return ws.Write(reply{Done: "bye"})
+	})
+	AddWebSocket(w, "/fail", func(ctx context.Context, ws *WebSocket[command, reply], params ParamsManager, req *http.Request) error {
+		return fmt.Errorf("device offline")
+	})
+	srv := wsServer(t, w)
+
+	c, _ := dialWS(t, srv, "/done")
+	if _, payload := c.recv(t); string(payload) != `{"device":"","done":"bye"}` {
+		t.Errorf("message = %s", payload)
+	}
+	if code := c.recvClose(t); code != CloseNormal {
+		t.Errorf("close code = %d, want %d", code, CloseNormal)
+	}
+	c.sendClose(CloseNormal)
+
+	c, _ = dialWS(t, srv, "/fail")
+	if code := c.recvClose(t); code != CloseInternalError {
+		t.Errorf("close code = %d, want %d", code, CloseInternalError)
+	}
+}
+
+func TestWebSocket_KeepaliveAndDisconnect(t *testing.T) {
+	w := Get()
+	w.SetWebSocket(WebSocketConfig{PingInterval: 20 * time.Millisecond, PongTimeout: time.Second})
+	cancelled := make(chan struct{})
+	AddWebSocket(w, "/ws", func(ctx context.Context, ws *WebSocket[command, reply], params ParamsManager, req *http.Request) error {
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	})
+	srv := wsServer(t, w)
+
+	c, _ := dialWS(t, srv, "/ws")
+	if op, _ := c.recv(t); op != opPing {
+		t.Fatalf("opcode = %x, want a ping", op)
+	}
+	c.send(opPong, "")
+
+	c.conn.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler context not cancelled after the client dropped")
+	}
+}
+
+func TestWebSocket_WriteOnlyHandler(t *testing.T) {
+	w := Get()
+	w.SetWebSocket(WebSocketConfig{MessageQueue: 2})
+	cancelled := make(chan struct{})
+	AddWebSocket(w, "/status", func(ctx context.Context, ws *WebSocket[command, reply], params ParamsManager, req *http.Request) error {
+		if err := ws.Write(reply{Done: "online"}); err != nil {
+			return err
+		}
+		<-ctx.Done() // never reads
+		close(cancelled)
+		return ctx.Err()
+	})
+	srv := wsServer(t, w)
+
+	c, _ := dialWS(t, srv, "/status")
+	if _, payload := c.recv(t); string(payload) != `{"device":"","done":"online"}` {
+		t.Fatalf("message = %s", payload)
+	}
+	for range 2 { // as many as the queue holds
+		c.send(opText, `{"action":"ignored"}`)
+	}
+
+	c.send(opPing, "still there?")
+	if op, payload := c.recv(t); op != opPong || string(payload) != "still there?" {
+		t.Fatalf("got opcode %x %q, want the pong", op, payload)
+	}
+
+	c.sendClose(CloseGoingAway)
+	if code := c.recvClose(t); code != CloseGoingAway {
+		t.Errorf("close code = %d, want %d echoed", code, CloseGoingAway)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler context not cancelled after the client closed")
+	}
+}
+
+func TestWebSocket_SlowReaderGetsEveryMessage(t *testing.T) {
+	w := Get()
+	w.SetWebSocket(WebSocketConfig{MessageQueue: 4})
+	read := make(chan []string, 1)
+	AddWebSocket(w, "/slow", func(ctx context.Context, ws *WebSocket[command, reply], params ParamsManager, req *http.Request) error {
+		time.Sleep(200 * time.Millisecond)
+		var actions []string
+		for len(actions) < 40 {
+			cmd, err := ws.Read()
+			if err != nil {
+				read <- actions
+				return err
+			}
+			actions = append(actions, cmd.Action)
+		}
+		read <- actions
+		return nil
+	})
+	srv := wsServer(t, w)
+
+	c, _ := dialWS(t, srv, "/slow")
+	for i := range 40 {
+		c.send(opText, fmt.Sprintf(`{"action":"%d"}`, i))
+	}
+
+	select {
+	case actions := <-read:
+		if len(actions) != 40 || actions[0] != "0" || actions[39] != "39" {
+			t.Errorf("read %d messages (%v), want all 40 in order", len(actions), actions)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not finish")
+	}
+	if code := c.recvClose(t); code != CloseNormal {
+		t.Errorf("close code = %d, want %d", code, CloseNormal)
+	}
+}
+
+func TestWebSocket_ReadDrainsQueueBeforeClose(t *testing.T) {
+	w := Get()
+	read := make(chan []string, 1)
+	AddWebSocket(w, "/batch", func(ctx context.Context, ws *WebSocket[command, reply], params ParamsManager, req *http.Request) error {
+		<-ctx.Done() // the client is gone before the first Read
+		var actions []string
+		for {
+			cmd, err := ws.Read()
+			if err != nil {
+				read <- actions
+				return err
+			}
+			actions = append(actions, cmd.Action)
+		}
+	})
+	srv := wsServer(t, w)
+
+	c, _ := dialWS(t, srv, "/batch")
+	c.send(opText, `{"action":"a"}`)
+	c.send(opText, `{"action":"b"}`)
+	c.sendClose(CloseNormal)
+	c.recvClose(t)
+
+	select {
+	case actions := <-read:
+		if strings.Join(actions, ",") != "a,b" {
+			t.Errorf("read %v, want the queued messages before the close", actions)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not finish")
+	}
+}
+
+func TestWebSocket_Subprotocol(t *testing.T) {
+	w := Get()
+	w.SetWebSocket(WebSocketConfig{Subprotocols: []string{"control.v2", "control.v1"}})
+	AddWebSocket(w, "/ws", func(ctx context.Context, ws *WebSocket[command, reply], params ParamsManager, req *http.Request) error {
+		return ws.Write(reply{Done: ws.Subprotocol()})
+	})
+	srv := wsServer(t, w)
+
+	c, resp := dialWS(t, srv, "/ws", "Sec-WebSocket-Protocol", "control.v1, control.v2")
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != "control.v2" {
+		t.Errorf("Sec-WebSocket-Protocol = %q, want the server's preference", got)
+	}
+	if _, payload := c.recv(t); !strings.Contains(string(payload), "control.v2") {
+		t.Errorf("message = %s", payload)
+	}
+}
+
+func TestWebSocketAccept(t *testing.T) {
+	if got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("websocketAccept = %q", got)
+	}
+}
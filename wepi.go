@@ -1,31 +1,102 @@
 package wepi
 
-import "sync"
+import (
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // WepiController manages routes, path matching, and CORS configuration.
+// It is safe to register routes and change settings while serving requests:
+// changes are published as copy-on-write snapshots that requests read atomically.
 type WepiController struct {
-	routes     sync.Map
-	pathRegexs []*PathReader
-	pathsMutex sync.Mutex
+	mu       sync.Mutex // serializes changes to table, settings, routes and groups
+	table    atomic.Pointer[routeTable]
+	settings atomic.Pointer[settings]
+}
+
+// routeTable is an immutable snapshot of the registered routes.
+type routeTable struct {
+	routes   map[string]*Route // by path+method; published copies of the routes
+	patterns []*PathReader     // templates with parameters, in registration order
+}
+
+// settings is an immutable snapshot of the controller configuration.
+type settings struct {
 	header     string
 	showErrors bool
-	cors       map[string]bool
+	cors       *corsPolicy
+
+	panicReporter  func(report PanicReport)
+	problemDetails bool
+
+	logger          *slog.Logger
+	requestLogLevel slog.Level
+	accessLog       *accessLogger
+	metrics         *metrics
+	tracing         *tracing
+	requestID       *RequestIDConfig
+	groups          []*RouteGroup // published copies of the groups
+	middlewares     []ContextMiddleware
+	provides        []AnyKey // keys set by the providers passed to UseProviders
+	beforeRouting   []func(http.Handler) http.Handler
+	compression     *compression
+
+	maxDecompressedSize int64
+	maxBodyBytes        int64
+	jsonLimits          JSONLimits
+	autoETags           bool
+	sseHeartbeat        time.Duration
+	streamFlushInterval time.Duration
+	webSocket           WebSocketConfig
 }
 
 // Get creates a new WepiController instance which can be used to add routes.
 func Get() *WepiController {
-	return &WepiController{
-		pathRegexs: make([]*PathReader, 0),
-		cors:       make(map[string]bool),
-	}
+	w := &WepiController{}
+	w.table.Store(&routeTable{routes: make(map[string]*Route)})
+	w.settings.Store(&settings{logger: slog.New(slog.DiscardHandler)})
+	return w
 }
 
-func (w *WepiController) AddRoutesHeader(header string) {
-	w.header = header
+// cfg returns the current settings snapshot.
+func (w *WepiController) cfg() *settings {
+	return w.settings.Load()
+}
+
+// update applies fn to a copy of the settings and publishes it.
+func (w *WepiController) update(fn func(s *settings)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.updateLocked(fn)
 }
 
-func (w *WepiController) AddAllowedCORS(cors string) {
-	w.cors[cors] = true
+// updateLocked is update for callers already holding w.mu.
+func (w *WepiController) updateLocked(fn func(s *settings)) {
+	s := *w.settings.Load()
+	s.groups = slices.Clip(s.groups)
+	s.middlewares = slices.Clip(s.middlewares)
+	s.provides = slices.Clip(s.provides)
+	s.beforeRouting = slices.Clip(s.beforeRouting)
+	fn(&s)
+	w.settings.Store(&s)
+}
+
+// updateTable applies fn to a copy of the route table and publishes it. w.mu must be held.
+func (w *WepiController) updateTable(fn func(t *routeTable)) {
+	t := *w.table.Load()
+	t.routes = maps.Clone(t.routes)
+	t.patterns = slices.Clip(t.patterns)
+	fn(&t)
+	w.table.Store(&t)
+}
+
+func (w *WepiController) AddRoutesHeader(header string) {
+	w.update(func(s *settings) { s.header = header })
 }
 
 // WepiComposedRoute holds a composed route to add to the controller.
@@ -36,14 +107,47 @@ type WepiComposedRoute struct {
 }
 
 func (w *WepiController) addRoute(converter *WepiComposedRoute) {
-	w.addPattern(converter.path)
-	w.routes.Store(converter.path+converter.method, converter.route)
+	if err := prepareRoute(converter); err != nil {
+		w.cfg().logger.Error("route template ignored", slog.String("route", converter.path), slog.Any("error", err))
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.updateTable(func(t *routeTable) { w.publishRoute(t, converter.route) })
+}
+
+// prepareRoute compiles the path template of a composed route.
+func prepareRoute(converter *WepiComposedRoute) error {
+	reg, keys, err := compileTemplate(converter.path)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		converter.route.pattern = &PathReader{regex: reg, keys: keys, pattern: converter.path}
+	}
+	return nil
+}
+
+// publishRoute adds a copy of route to the table t, replacing the route registered
+// for the same method and template. w.mu must be held.
+func (w *WepiController) publishRoute(t *routeTable, route *Route) {
+	route.controller = w
+	if route.pattern != nil && !slices.ContainsFunc(t.patterns, func(p *PathReader) bool { return p.pattern == route.route }) {
+		t.patterns = append(t.patterns, route.pattern)
+	}
+	t.routes[route.route+route.method] = route.snapshot()
+}
+
+// lookupRoute returns the published copy of the route registered under path+method.
+func (w *WepiController) lookupRoute(key string) (*Route, bool) {
+	r, ok := w.table.Load().routes[key]
+	return r, ok
 }
 
 func (w *WepiController) ShowErrors() bool {
-	return w.showErrors
+	return w.cfg().showErrors
 }
 
 func (w *WepiController) SetShowErrors() {
-	w.showErrors = true
+	w.update(func(s *settings) { s.showErrors = true })
 }